@@ -4,13 +4,41 @@
 //При необходимости поправить имя пользователя, пароль и адрес в ini-файле settings.ini (формат json)
 //Для первоначального заполнения базы можно использовать перечень городов, размещаемый в файле cities.csv
 //Для остановки программы используйте ctrl+c
+//Ответы на запросы чтения кэшируются (CacheSize и CacheTTL в settings.ini) и отдаются с заголовком ETag,
+//на запрос с совпадающим If-None-Match возвращается 304 Not Modified
+//Частота запросов ограничивается отдельно для /cities и /info: до аутентификации по IP-адресу клиента,
+//после нее дополнительно по проверенному API-ключу (или субъекту JWT)
+//(CitiesRate, CitiesBurst, InfoRate, InfoBurst в settings.ini), при превышении возвращается 429 с заголовком Retry-After.
+//Адрес клиента берется из X-Forwarded-For только за прокси на локальном адресе и прокси из TrustedProxies
+//При заданных TlsCert и TlsKey узел работает по HTTPS (TlsMinVersion - минимальная версия), при заданном TlsClientCA
+//требует клиентский сертификат. Подключение к базе настраивается параметрами DbSslMode и DbSslRootCert
+//Флаги запуска: -p порт сервера (по умолчанию из settings.ini), -replica подключение к реплике базы только для чтения
+//(адрес и порт реплики DbReplicaAdress и DbReplicaPort в settings.ini). Узлы реплики не заполняют базу и не сохраняют cities.csv
 //при выходе из программы все данные базы сохраняются в файл cities.csv
 //
+//Все запросы требуют API-ключ в заголовке X-API-Key. Роль reader дает доступ к GET /cities/xxx и /info,
+//editor дополнительно к добавлению и изменению городов, admin к удалению и управлению ключами:
+//GET /admin/keys - список ключей, POST /admin/keys с json-структурой вида {"name": string, "role": string} - новый ключ,
+//DELETE /admin/keys/name - удаление ключа. Первый ключ администратора создается запуском с флагами -newkey=name -role=admin
+//Вместо ключа можно передать JWT других сервисов в заголовке Authorization: Bearer (RS256/ES256, ключи из JWKS,
+//параметры Jwks* и Jwt* в settings.ini); роль берется из утверждения JwtRoleClaim через таблицу JwtRoles
+//Каждое добавление, изменение, удаление и импорт города, а также изменение города при правке справочников
+//(действие dictionary) и переносе в справочники (migrate) записывается в журнал auditLog (время, клиент, идентификатор
+//запроса, состояние до и после). Журнал: GET /admin/audit?city=xxx&actor=name&from=2023-01-01&to=2023-02-01&limit=100,
+//все параметры необязательны, время в формате RFC3339 или YYYY-MM-DD. Журнал выдается страницами (limit до 1000,
+//по умолчанию 100); если есть следующая страница, ее начало передается в заголовке X-Next-After-Id для ?after_id=
+//
 //Требуемые для работы модули:
 //1. github.com/lib/pq
 //2. Модуль обработчиков запросов handlers
 //3. Модуль с описанием структур (для передачи данных в формате json) structs
 //4. Модуль для взаимодействия с базой данных dbInterface
+//5. Модуль кэша ответов cache
+//6. Модуль ограничения частоты запросов ratelimit
+//7. Модуль аутентификации и проверки прав доступа auth
+//8. Модуль настройки TLS tlsconfig
+//9. Модуль форматов ввода и вывода списков городов format
+//10. Модуль ключей идемпотентности изменяющих запросов idempotency
 //
 //Примеры запросов:
 //получение информации о городе по его id: GET-запрос по адреу вида http://server_adress:server_port/cities/xxx, где xxx- уникальный ID города
@@ -20,29 +48,116 @@
 //		"region": string,
 //		"district": string,
 //		"population": int,
-//		"foundation": int }
+//		"foundation": int,
+//		"latitude": float,
+//		"longitude": float,
+//		"elevation": float,
+//		"area_km2": float }
+// численность и год основания могут быть null (неизвестны), годы до нашей эры задаются отрицательными (-1 - 1 год до н.э.);
+// координаты, высота и площадь необязательны. В cities.csv они задаются необязательными 7-10 столбцами
 //удаление информации о городе по указанному id: запрос DELETE по адресу  http://server_adress:server_port/cities/xxx,
-// где xxx- уникальный ID города
+// где xxx- уникальный ID города. Город только помечается удаленным и скрывается из всех запросов, окончательно он удаляется
+// через DeletedRetention (settings.ini). Администратор может увидеть удаленные города, добавив к запросу ?include_deleted=true
+//восстановление удаленного города: запрос POST по адресу http://server_adress:server_port/cities/xxx/restore
 //обновление информации о численности населения города по указанному id: запрос PUT по адресу http://server_adress:server_port/cities/xxx
-// где xxx- уникальный ID города, с json-структурой вида: {"value": int}
+// где xxx- уникальный ID города, с json-структурой вида: {"value": int, "date": string, "source": string}. Дата (YYYY-MM-DD
+// или год переписи YYYY, по умолчанию текущая) и источник необязательны. Все значения сохраняются в истории численности,
+// текущей численностью города становится значение с самой поздней датой
+//пакетное изменение городов: запрос POST http://server_adress:server_port/cities/batch с json-структурой вида
+// {"mode": "atomic" | "per_item", "operations": [{"op": "create", "city": {...}}, {"op": "update", "id": int,
+// "population": {...}}, {"op": "delete", "id": int}, ...]} (не более 1000 операций, удаление - только администратору).
+// Пакет выполняется в одной транзакции: в режиме atomic (по умолчанию) ошибка любой операции отменяет весь пакет,
+// в режиме per_item отменяется только ошибочная операция. В ответе {"committed": bool, "results": [...]} - статус
+// каждой операции (http-код, который вернул бы отдельный запрос, 424 - операция отменена вместе с пакетом).
+// У update и delete можно задать "version" - аналог If-Match; при RequireIfMatch операция без version получает 428
+//история численности города: запрос GET по адресу http://server_adress:server_port/cities/xxx/population-history
+//рост численности между двумя датами: запрос GET по адресу http://server_adress:server_port/cities/xxx/population-growth?from=2010&to=2021
+// (для отсутствующего или удаленного города - 404, история удаленного города доступна администратору с ?include_deleted=true)
+//нечеткий поиск города по названию: запрос GET http://server_adress:server_port/cities/search?q=xxx&limit=10.
+// Название можно задать в начале, с опечатками или латиницей (Nizhny Novgorod, Nižnij Novgorod по ISO 9),
+// города выводятся по убыванию сходства с запросом (score от 0 до 1)
+//другие названия города (исторические, разговорные, официальные на других языках): GET и POST по адресу
+// http://server_adress:server_port/cities/xxx/names с json-структурой вида {"name": string, "lang": "ru",
+// "kind": "official" | "historical" | "colloquial", "valid_from": int, "valid_to": int}, удаление - DELETE /cities/xxx/names/yyy.
+// Поиск и подсказки находят город и по другим названиям (Свердловск -> Екатеринбург). Для отсутствующего или
+// удаленного города GET возвращает 404, названия удаленного города доступны администратору с ?include_deleted=true
+//подсказки по началу названия: запрос GET http://server_adress:server_port/cities/suggest?q=xxx&limit=10,
+// города выводятся по убыванию численности. Индекс названий хранится в памяти узла и перечитывается из базы
+// каждые SuggestRefresh (settings.ini)
 //получение списка городов по указанному региону: запрос POST http://server_adress:server_port/cities/region
 // с json-структурой вида: {"request": string}
 //получение списка городов по указанному округу: запрос POST http://server_adress:server_port/cities/district
 // с json-структурой вида: {"request": string}
 //получения списка городов по указанному диапазону численности населения: запрос POST http://server_adress:server_port/cities/population
-// с json-структурой вида: {"min_value": int, "max_value": int}. Допускается указание одной границы диапазона.
+// с json-структурой вида: {"min_value": int, "max_value": int}. Любую из границ можно не указывать,
+// {"unknown": true} выбирает города, у которых значение неизвестно.
 //получения списка городов по указанному диапазону года основания: запрос POST http://server_adress:server_port/cities/foundation
-// с json-структурой вида: {"min_value": int, "max_value": int}. Допускается указание одной границы диапазона.
+// с json-структурой вида: {"min_value": int, "max_value": int}. Любую из границ можно не указывать,
+// {"unknown": true} выбирает города, у которых значение неизвестно.
+//получение списка городов в радиусе от точки: запрос POST http://server_adress:server_port/info/radius
+// с json-структурой вида: {"latitude": float, "longitude": float, "radius_km": float}
+//получение списка городов в прямоугольнике координат: запрос POST http://server_adress:server_port/info/bbox
+// с json-структурой вида: {"min_latitude": float, "min_longitude": float, "max_latitude": float, "max_longitude": float}
+//получение N ближайших к точке городов: запрос POST http://server_adress:server_port/info/nearest
+// с json-структурой вида: {"latitude": float, "longitude": float, "count": int}
+//списки /info по умолчанию выводятся текстом, с заголовком Accept: application/geo+json или параметром ?format=geojson -
+// в формате GeoJSON (FeatureCollection с полями города в properties)
+//статистика по регионам или округам (число городов, суммарная, средняя и медианная численность, старейший и самый
+// молодой город): запрос GET http://server_adress:server_port/stats/region или /stats/district
+//гистограмма численности: запрос POST http://server_adress:server_port/stats/histogram с json-структурой вида
+// {"buckets": [int, ...]} - возрастающие границы интервалов, без них используется шкала 1, 10, 100, ...
+//регионы и федеральные округа хранятся в справочниках, город при добавлении должен ссылаться на известные регион и округ
+// (название или код, сокращения вида "обл." допускаются и заменяются каноническим названием):
+// GET/POST http://server_adress:server_port/regions, GET/PUT/DELETE http://server_adress:server_port/regions/xxx
+// с json-структурой вида {"code": string, "name": string, "district_id": int}, аналогично /districts
+// с json-структурой вида {"code": string, "name": string}. Переименование переносится во все города региона
+//перенос текстовых регионов и округов существующих городов в справочники: запрос POST /admin/migrate-regions,
+// в ответе - отчет об объединенных написаниях. Для записей справочников добавляются английские названия
+//импорт городов администратором: запрос POST http://server_adress:server_port/admin/import с телом в формате cities.csv
+// или GeoJSON (Content-Type: application/geo+json); импорт выполняется целиком или не выполняется вовсе
+//тела запросов с неизвестными полями отклоняются. Неверные значения полей (пустое или слишком длинное название,
+// отрицательная численность, год основания в будущем и т.п.) возвращаются со статусом 422 в виде
+// {"violations": [{"field": string, "message": string}, ...]}; так же проверяются другие названия городов,
+// записи справочников и переводы их названий
+//у города может быть задана площадь "area_km2" (в cities.csv - необязательный 10-й столбец), в ответах выводятся
+// вычисляемые возраст "age" и плотность населения "density". Списки /info и /cities/search принимают ограничения
+// ?min_age=&max_age=, ?min_density=&max_density=, ?min_area=&max_area= и сортировку ?sort=поле или ?sort=-поле
+// (по убыванию), где поле - name, population, foundation, age, area, density или distance
+//названия городов, регионов и округов (в том числе в подсказках и справочниках /regions, /districts) выводятся
+// на языке из параметра ?lang=en (можно несколько через запятую)
+// или заголовка Accept-Language, при отсутствии перевода - по-русски. Переводы названий городов - другие названия
+// с "kind": "official" и нужным "lang" (/cities/xxx/names), переводы регионов и округов - GET /regions/xxx/names,
+// PUT и DELETE /regions/xxx/names/en с json-структурой вида {"name": string}, аналогично /districts
+//изменяющие запросы POST, PUT и DELETE к /cities, /regions, /districts и /admin (кроме /admin/keys, ответ которого
+// содержит ключ в открытом виде) принимают заголовок Idempotency-Key:
+// ответ на первый запрос с ключом хранится IdempotencyWindow (settings.ini), повтор запроса с тем же ключом
+// не выполняется повторно, а получает сохраненный ответ с заголовком Idempotent-Replayed: true. Повтор ключа
+// с другим телом запроса отклоняется с 422, повтор до завершения первого запроса - с 409 (если первый запрос
+// не завершился за IdempotencyInFlight, повтор выполняется заново)
+//GET /cities/xxx возвращает версию города в заголовке ETag (вида "v3-<хэш ответа>", у каждого языка и формата свой),
+// версия увеличивается при каждом изменении; If-Match сравнивает только версию.
+// PUT и DELETE /cities/xxx с заголовком If-Match выполняются, только если город не изменился с момента чтения,
+// иначе возвращается 412 Precondition Failed; при RequireIfMatch (settings.ini) запрос без If-Match отклоняется с 428.
+// В пакетных операциях update и delete ожидаемая версия задается полем "version"
+//запросы GET /cities/xxx и запросы списков /info принимают параметр ?as_of= (RFC3339 или YYYY-MM-DD) и возвращают
+// данные в том состоянии, в котором они были на указанный момент (история версий в таблице cityDataHistory)
 
 package main
 
 import (
 	"context"
 	"database/sql"
+	"cities/src/auth"
+	"cities/src/cache"
 	"cities/src/dbInterface"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"cities/src/handlers"
+	"cities/src/idempotency"
+	"cities/src/ratelimit"
+	"cities/src/suggest"
+	"cities/src/tlsconfig"
 	"log"
 	"net/http"
 	"os"
@@ -63,6 +178,49 @@ type parameters struct {
 	DbPort       string
 	DbUserName   string
 	DbPassword   string
+	//реплика для узлов, запущенных с флагом -replica
+	DbReplicaAdress string
+	DbReplicaPort   string
+	//кэш ответов на запросы чтения: число записей (0 - кэш выключен) и время жизни записи, например "30s"
+	CacheSize int
+	CacheTTL  string
+	//ограничение частоты запросов на клиента (запросов в секунду и размер пачки) для групп /cities и /info, 0 - без ограничения
+	CitiesRate  float64
+	CitiesBurst int
+	InfoRate    float64
+	InfoBurst   int
+	//адреса и подсети внешних прокси перед прокси узлов, которым разрешено передавать адрес клиента в X-Forwarded-For;
+	//прокси на локальном адресе доверенный всегда
+	TrustedProxies []string
+	//проверка JWT: источник JWKS (файл или URL, пусто - JWT не принимаются), издатель, аудитория, допуск на расхождение часов,
+	//утверждение с ролями и соответствие его значений ролям reader, editor, admin
+	JwksSource   string
+	JwtIssuer    string
+	JwtAudience  string
+	JwtClockSkew string
+	JwtRoleClaim string
+	JwtRoles     map[string]string
+	//TLS сервера: сертификат и ключ (пусто - обычный HTTP), минимальная версия протокола ("1.2", "1.3"),
+	//центр сертификации клиентов (если задан, узел принимает только запросы с клиентским сертификатом, например от прокси)
+	TlsCert       string
+	TlsKey        string
+	TlsMinVersion string
+	TlsClientCA   string
+	//удаленные города хранятся DeletedRetention (например "720h"), затем окончательно удаляются; проверка раз в PurgeInterval
+	DeletedRetention string
+	PurgeInterval    string
+	//период перечитывания индекса подсказок из базы, например "1m"
+	SuggestRefresh string
+	//время хранения ключей Idempotency-Key и ответов на запросы с ними, например "24h"; 0 - ключи не обрабатываются
+	IdempotencyWindow string
+	//наибольшее время выполнения запроса с Idempotency-Key: ключ незавершенного за это время запроса
+	//(например, при остановке узла) снова может быть занят повтором
+	IdempotencyInFlight string
+	//true - изменение и удаление города требуют заголовок If-Match с версией из ETag
+	RequireIfMatch bool
+	//режим sslmode подключения к PostgreSQL (по умолчанию disable) и корневой сертификат сервера базы
+	DbSslMode     string
+	DbSslRootCert string
 }
 
 func initRead(initParams *parameters) error {
@@ -84,6 +242,43 @@ func initRead(initParams *parameters) error {
 	return nil
 }
 
+// периодически окончательно удаляет города, помеченные удаленными дольше срока хранения
+func purgeDeleted(db *sql.DB, retention time.Duration, interval time.Duration) {
+	for range time.Tick(interval) {
+		purged, err := dbInterface.DbPurgeDeleted(retention, db) //удаленные города записываются в журнал в той же транзакции
+		if err != nil {
+			log.Print("purge of deleted cities failed: ", err)
+			continue
+		}
+		if len(purged) > 0 {
+			log.Printf("%d deleted cities purged", len(purged))
+		}
+	}
+}
+
+func loadSuggestIndex(db *sql.DB, index *suggest.Index) error {
+	cities, err := dbInterface.DbLoadCities(db)
+	if err != nil {
+		return err
+	}
+	names, err := dbInterface.DbAllCityNames(db)
+	if err != nil {
+		return err
+	}
+	index.Load(cities, names)
+	return nil
+}
+
+// периодически перечитывает индекс подсказок, чтобы учесть изменения, сделанные через другие узлы
+func refreshSuggestIndex(db *sql.DB, index *suggest.Index, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := loadSuggestIndex(db, index)
+		if err != nil {
+			log.Print("suggest index refresh failed: ", err)
+		}
+	}
+}
+
 func main() {
 
 	var initParams parameters
@@ -91,11 +286,27 @@ func main() {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	port := flag.String("p", initParams.ServerPort, "server port")
+	replica := flag.Bool("replica", false, "connect to the read-only replica instead of the primary database")
+	newKey := flag.String("newkey", "", "create an API key with this name, print it and exit")
+	newKeyRole := flag.String("role", "admin", "role of the key created with -newkey: reader, editor or admin")
+	flag.Parse()
+	initParams.ServerPort = *port
+	if *replica {
+		initParams.DbAdress = initParams.DbReplicaAdress
+		initParams.DbPort = initParams.DbReplicaPort
+	}
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	connectAttributes := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		initParams.DbAdress, initParams.DbPort, initParams.DbUserName, initParams.DbPassword, initParams.DbName)
+	if initParams.DbSslMode == "" {
+		initParams.DbSslMode = "disable"
+	}
+	connectAttributes := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		initParams.DbAdress, initParams.DbPort, initParams.DbUserName, initParams.DbPassword, initParams.DbName, initParams.DbSslMode)
+	if initParams.DbSslRootCert != "" {
+		connectAttributes += " sslrootcert=" + initParams.DbSslRootCert
+	}
 		
 	db, err := sql.Open("postgres", connectAttributes)
 	defer db.Close()
@@ -103,44 +314,217 @@ func main() {
 		log.Fatal("can't connect to db", err)
 	}
 
+	if *newKey != "" {
+		role, err := auth.ParseRole(*newKeyRole)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		key, err := auth.CreateKey(*newKey, role, db)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		fmt.Printf("API key %s (%s): %s\n", *newKey, role, key)
+		return
+	}
+
 	empty, err := dbInterface.DbEmptyCheck(db)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	if empty {
+	if empty && !*replica {
 		log.Println("Db probably is empty, reading data from cities.csv")
 		err = dbInterface.DbFillFromCsv("cities.csv", db)
 		if err != nil {
 			log.Println(err.Error())
 			log.Println("Starting with empty database")
 		}
+	} else if !*replica {
+		err = dbInterface.DbSeedNames(db)
+		if err != nil {
+			log.Println("other city names are not seeded: ", err.Error())
+		}
+	}
+	cacheTTL, err := time.ParseDuration(initParams.CacheTTL)
+	if err != nil {
+		log.Fatal("wrong CacheTTL value: ", err)
+	}
+	responseCache := cache.New(initParams.CacheSize, cacheTTL)
+
+	suggestRefresh, err := time.ParseDuration(initParams.SuggestRefresh)
+	if err != nil {
+		log.Fatal("wrong SuggestRefresh value: ", err)
+	}
+	suggestIndex := suggest.New()
+	err = loadSuggestIndex(db, suggestIndex)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	go refreshSuggestIndex(db, suggestIndex, suggestRefresh)
+
+	if !*replica {
+		retention, err := time.ParseDuration(initParams.DeletedRetention)
+		if err != nil {
+			log.Fatal("wrong DeletedRetention value: ", err)
+		}
+		purgeInterval, err := time.ParseDuration(initParams.PurgeInterval)
+		if err != nil {
+			log.Fatal("wrong PurgeInterval value: ", err)
+		}
+		go purgeDeleted(db, retention, purgeInterval)
+	}
+
+	postGIS, err := dbInterface.DbDetectPostGIS(db)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if postGIS {
+		log.Println("PostGIS found, using it for distance computations")
+	}
+
+	var jwtVerifier *auth.JWTVerifier
+	if initParams.JwksSource != "" {
+		clockSkew, err := time.ParseDuration(initParams.JwtClockSkew)
+		if err != nil {
+			log.Fatal("wrong JwtClockSkew value: ", err)
+		}
+		jwtVerifier, err = auth.NewJWTVerifier(auth.JWTConfig{
+			JwksSource: initParams.JwksSource,
+			Issuer:     initParams.JwtIssuer,
+			Audience:   initParams.JwtAudience,
+			ClockSkew:  clockSkew,
+			RoleClaim:  initParams.JwtRoleClaim,
+			RoleMap:    initParams.JwtRoles,
+		})
+		if err != nil {
+			log.Fatal("can't load JWKS: ", err)
+		}
+	}
+
+	idempotencyWindow, err := time.ParseDuration(initParams.IdempotencyWindow)
+	if err != nil {
+		log.Fatal("wrong IdempotencyWindow value: ", err)
+	}
+	idempotencyInFlight, err := time.ParseDuration(initParams.IdempotencyInFlight)
+	if err != nil {
+		log.Fatal("wrong IdempotencyInFlight value: ", err)
 	}
+	idempotencyKeys := idempotency.New(db, idempotencyWindow, idempotencyInFlight)
+
+	trustedProxies, err := ratelimit.ParseNetworks(append([]string{"127.0.0.0/8", "::1"}, initParams.TrustedProxies...))
+	if err != nil {
+		log.Fatal("wrong TrustedProxies value: ", err)
+	}
+
+	ifMatch := func(next http.Handler) http.Handler { return next }
+	if initParams.RequireIfMatch {
+		ifMatch = handlers.RequireIfMatch
+	}
+
 	fmt.Printf("db connected, waiting for command on adress %s port %s\n", initParams.ServerAdress, initParams.ServerPort)
 
 	r := chi.NewRouter()
 	if r != nil {
+		r.Use(middleware.RequestID) //идентификатор запроса берется из заголовка X-Request-Id, выставляемого прокси
 		r.Use(middleware.Logger)
 	}
 	r.Route("/cities", func(r chi.Router) {
-		r.Get("/{city_Id}", handlers.GetCityInfo(db))
-		r.Post("/", handlers.AddCityInfo(db))
-		r.Delete("/{city_Id}", handlers.DeleteCity(db))
-		r.Put("/{city_Id}", handlers.UpdatePopulation(db))
+		limiter := ratelimit.New(initParams.CitiesRate, initParams.CitiesBurst, trustedProxies)
+		r.Use(limiter.Handler)
+		r.Use(auth.Authenticate(db, jwtVerifier))
+		r.Use(limiter.KeyHandler(auth.Actor))
+		r.Use(idempotencyKeys.Handler)
+		r.With(auth.Require(auth.Reader)).Get("/search", handlers.SearchCities(db, responseCache))
+		r.With(auth.Require(auth.Reader)).Get("/suggest", handlers.Suggest(suggestIndex, db))
+		r.With(auth.Require(auth.Reader)).Get("/{city_Id}", handlers.GetCityInfo(db, responseCache))
+		r.With(auth.Require(auth.Editor)).Post("/", handlers.AddCityInfo(db, responseCache, suggestIndex))
+		r.With(auth.Require(auth.Editor)).Post("/batch", handlers.BatchCities(db, responseCache, suggestIndex, initParams.RequireIfMatch))
+		r.With(auth.Require(auth.Admin), ifMatch).Delete("/{city_Id}", handlers.DeleteCity(db, responseCache, suggestIndex))
+		r.With(auth.Require(auth.Editor), ifMatch).Put("/{city_Id}", handlers.UpdatePopulation(db, responseCache, suggestIndex))
+		r.With(auth.Require(auth.Admin)).Post("/{city_Id}/restore", handlers.RestoreCity(db, responseCache, suggestIndex))
+		r.With(auth.Require(auth.Reader)).Get("/{city_Id}/population-history", handlers.PopulationHistory(db, responseCache))
+		r.With(auth.Require(auth.Reader)).Get("/{city_Id}/population-growth", handlers.PopulationGrowth(db, responseCache))
+		r.With(auth.Require(auth.Reader)).Get("/{city_Id}/names", handlers.ListCityNames(db, responseCache))
+		r.With(auth.Require(auth.Editor)).Post("/{city_Id}/names", handlers.AddCityName(db, responseCache, suggestIndex))
+		r.With(auth.Require(auth.Editor)).Delete("/{city_Id}/names/{name_Id}", handlers.DeleteCityName(db, responseCache, suggestIndex))
 	})
 
 	r.Route("/info", func(r chi.Router) {
-		r.Post("/region", handlers.ListByRegion(db))
-		r.Post("/district", handlers.ListByDistrict(db))
-		r.Post("/population", handlers.ListByPopulation(db))
-		r.Post("/foundation", handlers.ListByFoundation(db))
+		limiter := ratelimit.New(initParams.InfoRate, initParams.InfoBurst, trustedProxies)
+		r.Use(limiter.Handler)
+		r.Use(auth.Authenticate(db, jwtVerifier))
+		r.Use(limiter.KeyHandler(auth.Actor))
+		r.Use(auth.Require(auth.Reader))
+		r.Post("/region", handlers.ListByRegion(db, responseCache))
+		r.Post("/district", handlers.ListByDistrict(db, responseCache))
+		r.Post("/population", handlers.ListByPopulation(db, responseCache))
+		r.Post("/foundation", handlers.ListByFoundation(db, responseCache))
+		r.Post("/radius", handlers.ListByRadius(db, responseCache))
+		r.Post("/bbox", handlers.ListByBoundingBox(db, responseCache))
+		r.Post("/nearest", handlers.ListNearest(db, responseCache))
+	})
+
+	r.Route("/stats", func(r chi.Router) {
+		limiter := ratelimit.New(initParams.InfoRate, initParams.InfoBurst, trustedProxies)
+		r.Use(limiter.Handler)
+		r.Use(auth.Authenticate(db, jwtVerifier))
+		r.Use(limiter.KeyHandler(auth.Actor))
+		r.Use(auth.Require(auth.Reader))
+		r.Post("/histogram", handlers.PopulationHistogram(db, responseCache))
+		r.Get("/{group}", handlers.GroupStats(db, responseCache))
+	})
+
+	for path, kind := range map[string]string{"/regions": "region", "/districts": "district"} {
+		kind := kind
+		r.Route(path, func(r chi.Router) {
+			limiter := ratelimit.New(initParams.InfoRate, initParams.InfoBurst, trustedProxies)
+			r.Use(limiter.Handler)
+			r.Use(auth.Authenticate(db, jwtVerifier))
+			r.Use(limiter.KeyHandler(auth.Actor))
+			r.Use(idempotencyKeys.Handler)
+			r.With(auth.Require(auth.Reader)).Get("/", handlers.ListDictionary(kind, db, responseCache))
+			r.With(auth.Require(auth.Reader)).Get("/{item_Id}", handlers.GetDictionaryItem(kind, db))
+			r.With(auth.Require(auth.Editor)).Post("/", handlers.AddDictionaryItem(kind, db, responseCache))
+			r.With(auth.Require(auth.Editor)).Put("/{item_Id}", handlers.UpdateDictionaryItem(kind, db, responseCache, suggestIndex))
+			r.With(auth.Require(auth.Admin)).Delete("/{item_Id}", handlers.DeleteDictionaryItem(kind, db, responseCache))
+			r.With(auth.Require(auth.Reader)).Get("/{item_Id}/names", handlers.ListDictionaryNames(kind, db, responseCache))
+			r.With(auth.Require(auth.Editor)).Put("/{item_Id}/names/{lang}", handlers.SetDictionaryName(kind, db, responseCache))
+			r.With(auth.Require(auth.Editor)).Delete("/{item_Id}/names/{lang}", handlers.DeleteDictionaryName(kind, db, responseCache))
+		})
+	}
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(auth.Authenticate(db, jwtVerifier))
+		r.Use(auth.Require(auth.Admin))
+		//ответ POST /admin/keys содержит ключ в открытом виде, поэтому ключи управляются без Idempotency-Key:
+		//сохраненный ответ хранил бы ключ в базе, где допустимы только хэши ключей
+		r.Get("/keys", handlers.ListApiKeys(db))
+		r.Post("/keys", handlers.CreateApiKey(db))
+		r.Delete("/keys/{key_Name}", handlers.DeleteApiKey(db))
+		r.Group(func(r chi.Router) {
+			r.Use(idempotencyKeys.Handler)
+			r.Get("/audit", handlers.ListAudit(db))
+			r.Post("/import", handlers.ImportCities(db, responseCache, suggestIndex))
+			r.Post("/migrate-regions", handlers.MigrateRegions(db, responseCache, suggestIndex))
+		})
 	})
 
 	srv := &http.Server{
 		Addr:    initParams.ServerAdress + ":" + initParams.ServerPort,
 		Handler: r,
 	}
+	if initParams.TlsCert != "" {
+		srv.TLSConfig, err = tlsconfig.Server(initParams.TlsMinVersion, initParams.TlsClientCA)
+		if err != nil {
+			log.Fatal("wrong TLS settings: ", err)
+		}
+	}
 	go func() {
-		err = srv.ListenAndServe()
+		var err error
+		if initParams.TlsCert != "" {
+			err = srv.ListenAndServeTLS(initParams.TlsCert, initParams.TlsKey)
+		} else {
+			err = srv.ListenAndServe()
+		}
 		if err != nil {
 			log.Print(err.Error())
 		}
@@ -153,9 +537,11 @@ func main() {
 		log.Fatalf("Server shutdown failed:%+v", err)
 	}
 
-	err = dbInterface.DbBackup(db)
-	if err != nil {
-		log.Fatal(err.Error())
+	if !*replica { //резервную копию сохраняют только узлы основной базы
+		err = dbInterface.DbBackup(db)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
 	}
 	log.Print("Node stopped")
 }
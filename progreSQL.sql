@@ -3,4 +3,161 @@ create table cityData (cityID int primary key unique not null,
 					   region varchar(30),
 					   district varchar(30),
 					   population int,
-					   foundation int)
\ No newline at end of file
+					   foundation int);
+
+create table apiKeys (keyHash char(64) primary key,
+					  keyName varchar(30) unique not null,
+					  role varchar(10) not null check (role in ('reader', 'editor', 'admin')),
+					  created timestamp not null default now());
+
+create table auditLog (id bigserial primary key,
+					   changed timestamptz not null default now(),
+					   actor varchar(100) not null,
+					   requestID varchar(100) not null default '',
+					   action varchar(10) not null,
+					   cityID int not null,
+					   before jsonb,
+					   after jsonb);
+
+create index auditLogCity on auditLog (cityID);
+create index auditLogActor on auditLog (actor);
+create index auditLogChanged on auditLog (changed);
+
+--журнал только дополняется: изменение и удаление записей запрещены
+create function auditLogAppendOnly() returns trigger as $$
+begin
+	raise exception 'auditLog is append-only';
+end;
+$$ language plpgsql;
+
+create trigger auditLogNoChange before update or delete or truncate on auditLog
+	for each statement execute function auditLogAppendOnly();
+
+--удаленные города только помечаются, окончательно они удаляются по истечении срока хранения
+alter table cityData add column deletedAt timestamptz;
+create index cityDataDeleted on cityData (deletedAt) where deletedAt is not null;
+
+--история численности: текущее значение cityData.population совпадает с записью с самой поздней датой
+create table populationHistory (id bigserial primary key,
+								cityID int not null references cityData (cityID) on delete cascade,
+								effective date not null,
+								population int not null,
+								source varchar(100) not null default '',
+								recorded timestamptz not null default now());
+
+create index populationHistoryCity on populationHistory (cityID, effective);
+
+insert into populationHistory (cityID, effective, population, source)
+	select cityID, current_date, population, 'initial' from cityData;
+
+--история версий строк cityData для запросов с as_of. Строка хранится в jsonb целиком, поэтому новые столбцы cityData
+--не требуют изменения истории. Действующая версия имеет validTo null
+create table cityDataHistory (id bigserial primary key,
+							  cityID int not null,
+							  rowData jsonb not null,
+							  validFrom timestamptz not null,
+							  validTo timestamptz);
+
+create index cityDataHistoryPeriod on cityDataHistory (validFrom, validTo);
+create index cityDataHistoryCity on cityDataHistory (cityID);
+
+create function cityDataVersion() returns trigger as $$
+begin
+	if tg_op in ('UPDATE', 'DELETE') then
+		update cityDataHistory set validTo=now() where cityID=old.cityID and validTo is null;
+	end if;
+	if tg_op in ('INSERT', 'UPDATE') then
+		insert into cityDataHistory (cityID, rowData, validFrom) values (new.cityID, to_jsonb(new), now());
+	end if;
+	return null;
+end;
+$$ language plpgsql;
+
+create trigger cityDataVersioning after insert or update or delete on cityData
+	for each row execute function cityDataVersion();
+
+insert into cityDataHistory (cityID, rowData, validFrom)
+	select cityID, to_jsonb(cityData), now() from cityData;
+
+--координаты города (градусы) и высота над уровнем моря (м), null - неизвестно
+alter table cityData add column latitude double precision check (latitude between -90 and 90),
+					 add column longitude double precision check (longitude between -180 and 180),
+					 add column elevation double precision;
+create index cityDataLocation on cityData (latitude, longitude);
+
+--справочники федеральных округов и регионов; normName - нормализованное название для сравнения написаний
+create table federalDistrict (id serial primary key,
+							  code varchar(10) unique,
+							  name varchar(30) not null,
+							  normName varchar(60) unique not null);
+
+create table region (id serial primary key,
+					 code varchar(10) unique,
+					 name varchar(30) not null,
+					 normName varchar(60) unique not null,
+					 districtID int references federalDistrict (id));
+
+alter table cityData add column regionID int references region (id),
+					 add column districtID int references federalDistrict (id);
+--после создания справочников выполнить POST /admin/migrate-regions для заполнения regionID и districtID
+
+--другие названия городов: kind - official (официальное на другом языке), historical или colloquial,
+--validFrom и validTo - годы действия названия, null - граница неизвестна или название действует сейчас
+create table cityNames (id serial primary key,
+						cityID int not null references cityData (cityID) on delete cascade,
+						name varchar(50) not null,
+						lang varchar(10) not null default 'ru',
+						kind varchar(20) not null check (kind in ('official', 'historical', 'colloquial')),
+						validFrom int,
+						validTo int,
+						check (validFrom is null or validTo is null or validFrom <= validTo));
+
+create index cityNamesCity on cityNames (cityID);
+
+--переводы названий регионов и федеральных округов; переводы названий городов хранятся в cityNames с kind 'official'
+create table localizedNames (kind varchar(10) not null check (kind in ('region', 'district')),
+							 itemID int not null,
+							 lang varchar(10) not null,
+							 name varchar(100) not null,
+							 primary key (kind, itemID, lang));
+
+--исторические и английские названия городов, регионов и округов добавляются программой: после заполнения cityData
+--из cities.csv, при каждом запуске узла основной базы (недостающие) и при POST /admin/migrate-regions
+
+--площадь города, км²; null - неизвестна. Возраст и плотность населения вычисляются при чтении
+alter table cityData add column area double precision check (area > 0);
+
+--неизвестные численность и год основания хранятся как null (раньше вместо неизвестного года записывался 0);
+--годы до нашей эры отрицательные, нулевого года нет
+update cityData set foundation = null where foundation = 0;
+alter table cityData add constraint cityDataFoundationYear check (foundation <> 0),
+					 add constraint cityDataPopulation check (population >= 0);
+
+--ключи идемпотентности изменяющих запросов: ответ на первый запрос с ключом повторяется при повторах клиента.
+--status null - первый запрос еще выполняется (запись старше IdempotencyInFlight может быть занята повтором).
+--Записи старше IdempotencyWindow (settings.ini) удаляются узлами
+create table idempotencyKeys (actor varchar(100) not null,
+							  key varchar(255) not null,
+							  requestHash char(64) not null,
+							  status int,
+							  contentType varchar(100) not null default '',
+							  etag varchar(100) not null default '',
+							  body bytea,
+							  created timestamptz not null default now(),
+							  primary key (actor, key));
+
+create index idempotencyKeysCreated on idempotencyKeys (created);
+
+--версия строки для оптимистичной блокировки: увеличивается при каждом изменении города, отдается в ETag
+--GET /cities/xxx и сверяется с If-Match при изменении и удалении
+alter table cityData add column version int not null default 1;
+
+create function cityDataRowVersion() returns trigger as $$
+begin
+	new.version := old.version + 1;
+	return new;
+end;
+$$ language plpgsql;
+
+create trigger cityDataVersionIncrement before update on cityData
+	for each row execute function cityDataRowVersion();
@@ -1,62 +1,207 @@
 package main
 
 import (
-	"bytes"
+	"cities/src/ratelimit"
+	"cities/src/tlsconfig"
 	"context"
-	"fmt"
-	"io"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"os"
 	"os/exec"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-const NODECOUNT = 2 //set number of nodes here
+const PRIMARYCOUNT = 1 //set number of nodes connected to the primary database here
+const REPLICACOUNT = 1 //set number of nodes connected to read-only replicas here
 
-func proxyHandler(currentNode *int) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		nodePort := ":" + strconv.Itoa(9000+*currentNode)
-		*currentNode += 1
-		if *currentNode > NODECOUNT {
-			*currentNode = 1
+const PROXYRATE = 50   //requests per second allowed for one client, 0 disables the limit
+const PROXYBURST = 100 //number of requests a client may send at once
+
+const STICKYWINDOW = 10 * time.Second //how long reads of a client go to the primary after its write
+
+const requestIdHeader = "X-Request-Id"
+
+// после записи клиент получает срок (unix-время), до которого его чтения направляются на основную базу.
+// Срок передается cookie или заголовком, который клиент может вернуть в следующих запросах
+const stickyCookie = "cities_primary_until"
+const stickyHeader = "X-Read-Your-Writes"
+
+// общий транспорт для всех запросов к узлам: соединения переиспользуются, зависшие узлы отваливаются по таймауту
+var nodeTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   32,
+	IdleConnTimeout:       90 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// схема запросов к узлам, https при запуске с флагом -nodeca
+var nodeScheme = "http"
+
+func newRequestId() string {
+	buff := make([]byte, 16)
+	if _, err := rand.Read(buff); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buff)
+}
+
+// набор узлов одного типа с циклическим перебором
+type nodePool struct {
+	ports []int
+	next  uint32
+}
+
+func newNodePool(firstPort, count int) *nodePool {
+	pool := &nodePool{}
+	for i := 0; i < count; i++ {
+		pool.ports = append(pool.ports, firstPort+i)
+	}
+	return pool
+}
+
+func (p *nodePool) pick() int {
+	n := atomic.AddUint32(&p.next, 1) - 1
+	return p.ports[n%uint32(len(p.ports))]
+}
+
+// POST-запросы, которые только читают данные (параметры поиска передаются в теле)
+var readOnlyPosts = []string{"/info/", "/stats/histogram"}
+
+// запись - любой запрос, кроме GET, HEAD, OPTIONS и читающих POST readOnlyPosts. Все записи, включая справочники,
+// названия и /admin, должны идти на основную базу: реплика только для чтения их отклонит
+func isWrite(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		return false
+	}
+	if r.Method == http.MethodPost {
+		for _, prefix := range readOnlyPosts {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				return false
+			}
 		}
-		byteBody, _ := io.ReadAll(r.Body)
-		buff := bytes.NewBuffer(byteBody)
-		defer r.Body.Close()
-		q := ""
-		if r.URL.RawQuery != "" {
-			q = "?" + r.URL.RawQuery
+	}
+	return true
+}
+
+func stickyToPrimary(r *http.Request) bool {
+	until := r.Header.Get(stickyHeader)
+	if cookie, err := r.Cookie(stickyCookie); err == nil && until == "" {
+		until = cookie.Value
+	}
+	if until == "" {
+		return false
+	}
+	deadline, err := strconv.ParseInt(until, 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().Unix() < deadline
+}
+
+// trusted - внешние прокси, X-Forwarded-For которых передается узлам; от остальных клиентов заголовок отбрасывается,
+// и узлы получают только адрес, дописанный ReverseProxy
+func proxyHandler(primary *nodePool, replicas *nodePool, trusted []*net.IPNet) http.Handler {
+	director := func(r *http.Request) {
+		pool := primary
+		if len(replicas.ports) > 0 && !isWrite(r) && !stickyToPrimary(r) {
+			pool = replicas
 		}
-		requestPath := "http://127.0.0.1" + nodePort + r.URL.Path + q
-		fmt.Println("Redirected to",requestPath)
-		req, err := http.NewRequest(r.Method, requestPath, buff)
-		if err != nil {
-			log.Fatal(err.Error())
+		r.URL.Scheme = nodeScheme
+		r.URL.Host = "127.0.0.1:" + strconv.Itoa(pool.pick())
+
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
 		}
-		client := &http.Client{}
-		responce, err := client.Do(req)
-		if err != nil {
-			log.Fatal(err.Error())
+		r.Header.Set("X-Forwarded-Proto", proto)
+		r.Header.Set("X-Forwarded-Host", r.Host)
+		if r.Header.Get(requestIdHeader) == "" {
+			r.Header.Set(requestIdHeader, newRequestId())
 		}
-
-		w.WriteHeader(responce.StatusCode)
-		w.Header().Set("Content-Type", responce.Header.Get("Content-Type"))
-		w.Header().Set("Content-Length", responce.Header.Get("Content-Length"))
-		io.Copy(w, responce.Body)
-		defer responce.Body.Close()
-
+		if !ratelimit.TrustedPeer(r, trusted) {
+			r.Header.Del("X-Forwarded-For")
+		}
+		// X-Forwarded-For дописывает сам ReverseProxy
+		log.Println("Redirected to", r.URL.String(), "request id", r.Header.Get(requestIdHeader))
+	}
+	return &httputil.ReverseProxy{
+		Director:  director,
+		Transport: nodeTransport,
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Set(requestIdHeader, resp.Request.Header.Get(requestIdHeader))
+			if isWrite(resp.Request) && resp.StatusCode < http.StatusBadRequest {
+				until := strconv.FormatInt(time.Now().Add(STICKYWINDOW).Unix(), 10)
+				resp.Header.Set(stickyHeader, until)
+				cookie := &http.Cookie{
+					Name:     stickyCookie,
+					Value:    until,
+					Path:     "/",
+					MaxAge:   int(STICKYWINDOW / time.Second),
+					HttpOnly: true,
+				}
+				resp.Header.Add("Set-Cookie", cookie.String())
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("node %s error: %s", r.URL.Host, err.Error())
+			w.Header().Set(requestIdHeader, r.Header.Get(requestIdHeader))
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("node is unavailable"))
+		},
 	}
 }
 
 func main() {
-	var currentNode int = 1
-	for i := 1; i <= NODECOUNT; i++ {
-		nodeArg := "-p=" + strconv.Itoa(9000+i)
-		cmd := exec.Command("./node.exe", nodeArg)
+	certFile := flag.String("cert", "", "proxy TLS certificate, plain HTTP if empty")
+	keyFile := flag.String("key", "", "proxy TLS key")
+	minVersion := flag.String("minversion", "1.2", "minimal TLS version of the proxy listener")
+	clientCA := flag.String("clientca", "", "CA for client certificates, clients must present one if set")
+	nodeCA := flag.String("nodeca", "", "CA of node certificates, connect to nodes over HTTPS if set")
+	nodeCert := flag.String("nodecert", "", "client certificate presented to nodes")
+	nodeKey := flag.String("nodekey", "", "key of the client certificate presented to nodes")
+	trustedList := flag.String("trustedproxies", "", "comma-separated addresses or networks of front proxies allowed to set X-Forwarded-For")
+	flag.Parse()
+	trusted, err := ratelimit.ParseNetworks(strings.Split(*trustedList, ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *nodeCA != "" {
+		tlsConfig, err := tlsconfig.Client(*nodeCA, *nodeCert, *nodeKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		nodeTransport.TLSClientConfig = tlsConfig
+		nodeTransport.TLSHandshakeTimeout = 5 * time.Second
+		nodeScheme = "https"
+	}
+
+	primary := newNodePool(9001, PRIMARYCOUNT)
+	replicas := newNodePool(9001+PRIMARYCOUNT, REPLICACOUNT)
+	for _, port := range primary.ports {
+		cmd := exec.Command("./node.exe", "-p="+strconv.Itoa(port))
+		err := cmd.Start()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, port := range replicas.ports {
+		cmd := exec.Command("./node.exe", "-p="+strconv.Itoa(port), "-replica")
 		err := cmd.Start()
 		if err != nil {
 			log.Fatal(err)
@@ -66,15 +211,28 @@ func main() {
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	http.HandleFunc("/", proxyHandler(&currentNode))
+	http.Handle("/", ratelimit.New(PROXYRATE, PROXYBURST, trusted).Handler(proxyHandler(primary, replicas, trusted)))
 
 	srv := &http.Server{
 		Addr:    "127.0.0.1:9000",
 		Handler: nil,
 	}
 
+	if *certFile != "" {
+		var err error
+		srv.TLSConfig, err = tlsconfig.Server(*minVersion, *clientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	go func() {
-		err := srv.ListenAndServe()
+		var err error
+		if *certFile != "" {
+			err = srv.ListenAndServeTLS(*certFile, *keyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
 		if err != nil {
 			log.Print(err.Error())
 		}
@@ -0,0 +1,147 @@
+//Модуль аутентификации и проверки прав доступа
+
+//Клиент передает API-ключ в заголовке X-API-Key или JWT в заголовке Authorization (см. jwt.go). В базе хранится только SHA-256 ключа (таблица apiKeys).
+//Роли упорядочены по возрастанию прав: reader (чтение /cities и /info), editor (добавление и изменение),
+//admin (удаление, восстановление, импорт и управление ключами)
+
+package auth
+
+import (
+	"cities/src/dbInterface"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type Role int
+
+const (
+	Reader Role = iota + 1
+	Editor
+	Admin
+)
+
+var roleNames = map[Role]string{Reader: "reader", Editor: "editor", Admin: "admin"}
+
+func (role Role) String() string {
+	return roleNames[role]
+}
+
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if roleName == name {
+			return role, nil
+		}
+	}
+	return 0, errors.New("unknown role " + name + ", expected reader, editor or admin")
+}
+
+// кто выполняет запрос: имя ключа и его роль
+type Identity struct {
+	Actor string
+	Role  Role
+}
+
+type contextKey struct{}
+
+func FromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(contextKey{}).(Identity)
+	return identity, ok
+}
+
+// имя клиента для журналов, пустая строка для неаутентифицированных запросов
+func Actor(r *http.Request) string {
+	identity, _ := FromContext(r.Context())
+	return identity.Actor
+}
+
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func GenerateKey() (string, error) {
+	buff := make([]byte, 24)
+	if _, err := rand.Read(buff); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buff), nil
+}
+
+// создает ключ с указанной ролью и возвращает его. Ключ показывается только один раз, в базе остается его хэш
+func CreateKey(name string, role Role, db *sql.DB) (string, error) {
+	key, err := GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	err = dbInterface.DbAddApiKey(name, HashKey(key), role.String(), db)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func deny(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	w.Write([]byte(message))
+}
+
+func apiKeyIdentity(key string, db *sql.DB) (Identity, error) {
+	name, roleName, err := dbInterface.DbFindApiKey(HashKey(key), db)
+	if err != nil {
+		return Identity{}, errors.New("invalid API key")
+	}
+	role, err := ParseRole(roleName)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{Actor: name, Role: role}, nil
+}
+
+// определяет клиента по токену (если задан verifier) или по ключу и сохраняет его в контексте запроса
+func Authenticate(db *sql.DB, verifier *JWTVerifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var identity Identity
+			var err error
+			authorization := r.Header.Get("Authorization")
+			switch {
+			case verifier != nil && strings.HasPrefix(authorization, "Bearer "):
+				identity, err = verifier.Verify(strings.TrimPrefix(authorization, "Bearer "))
+			case r.Header.Get("X-API-Key") != "":
+				identity, err = apiKeyIdentity(r.Header.Get("X-API-Key"), db)
+			default:
+				err = errors.New("API key or bearer token required")
+			}
+			if err != nil {
+				deny(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			ctx := context.WithValue(r.Context(), contextKey{}, identity)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// пропускает запрос, только если роль клиента не ниже указанной
+func Require(role Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, ok := FromContext(r.Context())
+			if !ok {
+				deny(w, http.StatusUnauthorized, "API key required")
+				return
+			}
+			if identity.Role < role {
+				deny(w, http.StatusForbidden, "role "+role.String()+" required")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,317 @@
+//Проверка JWT, выпущенных другими сервисами
+
+//Токен передается в заголовке Authorization: Bearer <token>. Поддерживаются подписи RS256 и ES256,
+//открытые ключи берутся из JWKS (файл или URL). Проверяются iss, aud, exp и nbf с допуском на расхождение часов.
+//Роль определяется по утверждению RoleClaim (строка через пробел или массив строк) с помощью таблицы RoleMap,
+//при нескольких подходящих значениях выбирается наибольшая роль
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// как часто перечитывать JWKS при встрече неизвестного kid
+const jwksRefreshInterval = time.Minute
+
+type JWTConfig struct {
+	JwksSource string //путь к файлу или http(s) URL с набором ключей
+	Issuer     string
+	Audience   string
+	ClockSkew  time.Duration
+	RoleClaim  string
+	RoleMap    map[string]string //значение утверждения -> reader, editor или admin
+}
+
+type JWTVerifier struct {
+	config JWTConfig
+	mu     sync.Mutex
+	keys   map[string]crypto.PublicKey
+	loaded time.Time
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func NewJWTVerifier(config JWTConfig) (*JWTVerifier, error) {
+	if config.RoleClaim == "" {
+		config.RoleClaim = "roles"
+	}
+	verifier := &JWTVerifier{config: config}
+	err := verifier.loadKeys()
+	if err != nil {
+		return nil, err
+	}
+	return verifier, nil
+}
+
+func readJwks(source string) ([]byte, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New("JWKS request failed: " + resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	}
+	return os.ReadFile(source)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	buff, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(buff), nil
+}
+
+func parseJwk(jwk jsonWebKey) (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, errors.New("unsupported curve " + jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("EC key point is not on curve P-256")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + jwk.Kty)
+}
+
+func (v *JWTVerifier) loadKeys() error {
+	buff, err := readJwks(v.config.JwksSource)
+	if err != nil {
+		return err
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.Unmarshal(buff, &jwks)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		key, err := parseJwk(jwk)
+		if err != nil {
+			continue //ключи неподдерживаемых типов пропускаются
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("no usable keys in JWKS " + v.config.JwksSource)
+	}
+	v.keys = keys
+	v.loaded = time.Now()
+	return nil
+}
+
+// ключ по kid; при неизвестном kid набор перечитывается, но не чаще jwksRefreshInterval
+func (v *JWTVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(v.loaded) > jwksRefreshInterval {
+		err := v.loadKeys()
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := v.keys[kid]; ok {
+			return key, nil
+		}
+	}
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, nil
+		}
+	}
+	return nil, errors.New("unknown signing key " + kid)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hash := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RS256 token signed with non-RSA key")
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hash[:], signature)
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("ES256 token signed with non-EC key")
+		}
+		if len(signature) != 64 {
+			return errors.New("wrong ES256 signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, hash[:], r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported signing algorithm " + alg)
+}
+
+// значение утверждения в виде списка строк: "a b c" или ["a", "b", "c"]
+func claimValues(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func (v *JWTVerifier) checkTime(claims map[string]interface{}) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiration time")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.config.ClockSkew)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.config.ClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+func (v *JWTVerifier) role(claims map[string]interface{}) (Role, error) {
+	var best Role
+	for _, value := range claimValues(claims[v.config.RoleClaim]) {
+		roleName := value
+		if len(v.config.RoleMap) > 0 {
+			roleName = v.config.RoleMap[value]
+		}
+		role, err := ParseRole(roleName)
+		if err == nil && role > best {
+			best = role
+		}
+	}
+	if best == 0 {
+		return 0, errors.New("token grants no role")
+	}
+	return best, nil
+}
+
+func (v *JWTVerifier) Verify(token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, errors.New("malformed token")
+	}
+	headerBuff, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Identity{}, errors.New("malformed token header")
+	}
+	var header jwtHeader
+	if err = json.Unmarshal(headerBuff, &header); err != nil {
+		return Identity{}, errors.New("malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, errors.New("malformed token signature")
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return Identity{}, err
+	}
+	err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	claimsBuff, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Identity{}, errors.New("malformed token claims")
+	}
+	claims := make(map[string]interface{})
+	if err = json.Unmarshal(claimsBuff, &claims); err != nil {
+		return Identity{}, errors.New("malformed token claims")
+	}
+	if err = v.checkTime(claims); err != nil {
+		return Identity{}, err
+	}
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return Identity{}, errors.New("wrong token issuer")
+	}
+	if v.config.Audience != "" {
+		audienceOk := false
+		for _, audience := range claimValues(claims["aud"]) {
+			audienceOk = audienceOk || audience == v.config.Audience
+		}
+		if !audienceOk {
+			return Identity{}, errors.New("wrong token audience")
+		}
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return Identity{}, errors.New("token has no subject")
+	}
+	role, err := v.role(claims)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{Actor: "jwt:" + subject, Role: role}, nil
+}
@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.example"
+	testAudience = "cities"
+	testSkew     = time.Minute
+)
+
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func encodeSegment(t *testing.T, value interface{}) string {
+	buff, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buff)
+}
+
+func encodeBigInt(value *big.Int, size int) string {
+	buff := make([]byte, size)
+	return base64.RawURLEncoding.EncodeToString(value.FillBytes(buff))
+}
+
+// создает ключи RS256 и ES256 и верификатор с JWKS из временного файла
+func newTestVerifier(t *testing.T) (*JWTVerifier, testKeys) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := map[string][]jsonWebKey{"keys": {
+		{Kty: "RSA", Kid: "rsa", N: base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: encodeBigInt(ecKey.X, 32), Y: encodeBigInt(ecKey.Y, 32)},
+	}}
+	buff, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(source, buff, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewJWTVerifier(JWTConfig{JwksSource: source, Issuer: testIssuer, Audience: testAudience,
+		ClockSkew: testSkew, RoleClaim: "roles", RoleMap: map[string]string{"cities-editor": "editor", "cities-admin": "admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verifier, testKeys{rsa: rsaKey, ec: ecKey}
+}
+
+// действующие утверждения; тесты изменяют их по одному
+func validClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"sub":   "user-1",
+		"iss":   testIssuer,
+		"aud":   testAudience,
+		"exp":   now.Add(time.Hour).Unix(),
+		"nbf":   now.Add(-time.Hour).Unix(),
+		"roles": []string{"cities-editor"},
+	}
+}
+
+func sign(t *testing.T, keys testKeys, alg string, kid string, claims map[string]interface{}) string {
+	signed := encodeSegment(t, jwtHeader{Alg: alg, Kid: kid}) + "." + encodeSegment(t, claims)
+	hash := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, keys.rsa, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, keys.ec, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "HS256":
+		//подпись открытым модулем RSA-ключа как секретом - классическая подмена алгоритма
+		mac := hmac.New(sha256.New, keys.rsa.N.Bytes())
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyValidTokens(t *testing.T) {
+	verifier, keys := newTestVerifier(t)
+	for _, test := range []struct{ alg, kid string }{{"RS256", "rsa"}, {"ES256", "ec"}} {
+		identity, err := verifier.Verify(sign(t, keys, test.alg, test.kid, validClaims()))
+		if err != nil {
+			t.Fatalf("%s: %v", test.alg, err)
+		}
+		if identity.Actor != "jwt:user-1" || identity.Role != Editor {
+			t.Errorf("%s: got %+v", test.alg, identity)
+		}
+	}
+}
+
+func TestVerifyHighestRole(t *testing.T) {
+	verifier, keys := newTestVerifier(t)
+	claims := validClaims()
+	claims["roles"] = "unknown cities-admin cities-editor"
+	identity, err := verifier.Verify(sign(t, keys, "ES256", "ec", claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Role != Admin {
+		t.Errorf("role %v, want admin", identity.Role)
+	}
+}
+
+func TestVerifyRejectsTamperedPayload(t *testing.T) {
+	verifier, keys := newTestVerifier(t)
+	for _, test := range []struct{ alg, kid string }{{"RS256", "rsa"}, {"ES256", "ec"}} {
+		parts := strings.Split(sign(t, keys, test.alg, test.kid, validClaims()), ".")
+		claims := validClaims()
+		claims["roles"] = []string{"cities-admin"}
+		parts[1] = encodeSegment(t, claims)
+		if _, err := verifier.Verify(strings.Join(parts, ".")); err == nil {
+			t.Errorf("%s: token with tampered payload accepted", test.alg)
+		}
+	}
+}
+
+func TestVerifyRejectsOtherAlgorithms(t *testing.T) {
+	verifier, keys := newTestVerifier(t)
+	unsigned := encodeSegment(t, jwtHeader{Alg: "none", Kid: "rsa"}) + "." + encodeSegment(t, validClaims()) + "."
+	//подпись ES256 с заголовком, объявляющим RS256
+	parts := strings.Split(sign(t, keys, "ES256", "ec", validClaims()), ".")
+	parts[0] = encodeSegment(t, jwtHeader{Alg: "RS256", Kid: "ec"})
+	for name, token := range map[string]string{
+		"none":              unsigned,
+		"HS256":             sign(t, keys, "HS256", "rsa", validClaims()),
+		"RS256 with EC key": strings.Join(parts, "."),
+	} {
+		if _, err := verifier.Verify(token); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
+
+func TestVerifyTimeBoundaries(t *testing.T) {
+	verifier, keys := newTestVerifier(t)
+	now := time.Now()
+	margin := 10 * time.Second
+	tests := []struct {
+		name  string
+		claim string
+		value time.Time
+		valid bool
+	}{
+		{"expired within skew", "exp", now.Add(-testSkew + margin), true},
+		{"expired beyond skew", "exp", now.Add(-testSkew - margin), false},
+		{"not yet valid within skew", "nbf", now.Add(testSkew - margin), true},
+		{"not yet valid beyond skew", "nbf", now.Add(testSkew + margin), false},
+	}
+	for _, test := range tests {
+		claims := validClaims()
+		claims[test.claim] = test.value.Unix()
+		_, err := verifier.Verify(sign(t, keys, "RS256", "rsa", claims))
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: token accepted", test.name)
+		}
+	}
+	claims := validClaims()
+	delete(claims, "exp")
+	if _, err := verifier.Verify(sign(t, keys, "RS256", "rsa", claims)); err == nil {
+		t.Error("token without exp accepted")
+	}
+}
+
+func TestVerifyRejectsWrongClaims(t *testing.T) {
+	verifier, keys := newTestVerifier(t)
+	tests := map[string]func(claims map[string]interface{}){
+		"wrong audience": func(claims map[string]interface{}) { claims["aud"] = []string{"other", "service"} },
+		"wrong issuer":   func(claims map[string]interface{}) { claims["iss"] = "https://other.example" },
+		"missing role":   func(claims map[string]interface{}) { delete(claims, "roles") },
+		"unmapped role":  func(claims map[string]interface{}) { claims["roles"] = "reader" },
+		"no subject":     func(claims map[string]interface{}) { delete(claims, "sub") },
+	}
+	for name, change := range tests {
+		claims := validClaims()
+		change(claims)
+		if _, err := verifier.Verify(sign(t, keys, "ES256", "ec", claims)); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
+
+func TestVerifyRejectsUnknownKey(t *testing.T) {
+	verifier, keys := newTestVerifier(t)
+	if _, err := verifier.Verify(sign(t, keys, "RS256", "other", validClaims())); err == nil {
+		t.Error("token with unknown kid accepted")
+	}
+}
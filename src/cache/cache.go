@@ -0,0 +1,101 @@
+//Модуль кэша ответов на запросы чтения
+
+//Кэш хранит готовые ответы узла в памяти процесса (LRU с ограничением времени жизни записи).
+//Любое изменение данных через этот узел полностью очищает кэш; изменения, сделанные через другие узлы,
+//становятся видны не позднее чем через время жизни записи
+
+package cache
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	key     string
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+type Cache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	order *list.List //в начале списка недавно использованные записи
+}
+
+// При size <= 0 кэш ничего не хранит
+func New(size int, ttl time.Duration) *Cache {
+	return &Cache{
+		size:  size,
+		ttl:   ttl,
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+func Etag(body []byte) string {
+	sum := sha1.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (c *Cache) Get(key string) (body []byte, etag string, ok bool) {
+	if c == nil {
+		return nil, "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, "", false
+	}
+	item := elem.Value.(*entry)
+	if time.Now().After(item.expires) {
+		c.order.Remove(elem)
+		delete(c.items, key)
+		return nil, "", false
+	}
+	c.order.MoveToFront(elem)
+	return item.body, item.etag, true
+}
+
+func (c *Cache) Set(key string, body []byte) (etag string) {
+	return c.SetTagged(key, body, Etag(body))
+}
+
+// сохраняет ответ с заданным ETag (например, версией строки) вместо хэша тела
+func (c *Cache) SetTagged(key string, body []byte, etag string) string {
+	if c == nil || c.size <= 0 {
+		return etag
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		item := elem.Value.(*entry)
+		item.body, item.etag, item.expires = body, etag, time.Now().Add(c.ttl)
+		c.order.MoveToFront(elem)
+		return etag
+	}
+	c.items[key] = c.order.PushFront(&entry{key: key, body: body, etag: etag, expires: time.Now().Add(c.ttl)})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*entry).key)
+	}
+	return etag
+}
+
+func (c *Cache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+}
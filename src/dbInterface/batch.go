@@ -0,0 +1,47 @@
+//Модуль пакетного изменения городов
+
+//Все операции пакета выполняются в одной транзакции. В режиме atomic первая ошибка откатывает весь пакет,
+//в режиме per_item каждая операция выполняется в своей точке сохранения и её ошибка откатывает только её саму.
+//Запись в журнал изменений делается в той же транзакции, поэтому откаченные операции в журнал не попадают
+
+package dbInterface
+
+import (
+	"cities/src/structs"
+	"database/sql"
+)
+
+// выполняет операции пакета, операции должны быть уже проверены, а у update - задана дата Effective.
+// Возвращает ошибки по операциям (nil - операция выполнена); в режиме atomic при ошибке любой операции
+// пакет откатывается целиком, а следующие операции не выполняются. err - ошибка самой транзакции
+func DbBatch(operations []structs.BatchOperation, atomic bool, actor string, requestId string, db *sql.DB) (opErrs []error, err error) {
+	opErrs = make([]error, len(operations))
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for i := range operations {
+		if atomic {
+			_, opErrs[i] = dbCityOperation(&operations[i], actor, requestId, tx)
+			if opErrs[i] != nil {
+				return opErrs, nil
+			}
+			continue
+		}
+		_, err = tx.Exec("SAVEPOINT batch_item")
+		if err != nil {
+			return nil, err
+		}
+		_, opErrs[i] = dbCityOperation(&operations[i], actor, requestId, tx)
+		if opErrs[i] != nil {
+			_, err = tx.Exec("ROLLBACK TO SAVEPOINT batch_item")
+		} else {
+			_, err = tx.Exec("RELEASE SAVEPOINT batch_item")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return opErrs, tx.Commit()
+}
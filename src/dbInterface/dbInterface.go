@@ -5,13 +5,19 @@ package dbInterface
 import (
 	"database/sql"
 	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
+	"math"
 	"os"
 	"strconv"
 	"strings"
+	"time"
+	"cities/src/format"
+	"cities/src/search"
 	"cities/src/structs"
+
+	"github.com/lib/pq"
 )
 
 func DbEmptyCheck(db *sql.DB) (empty bool, dbErr error) {
@@ -30,40 +36,46 @@ func DbFillFromCsv(fileName string, db *sql.DB) error {
 		return err
 	}
 	defer inFile.Close()
-	inFileInfo, _ := inFile.Stat()
-	var buff = make([]byte, inFileInfo.Size())
-	_, err = inFile.Read(buff)
+	cities, err := format.ParseCsv(inFile)
 	if err != nil {
 		return err
 	}
-	r := csv.NewReader(strings.NewReader(string(buff)))
-	for {
-		record, err := r.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		newCityData := new(structs.CityInfo)
-		newCityData.Id, err = strconv.Atoi(record[0])
-		if err != nil {
-			return err
-		}
-		newCityData.Name = record[1]
-		newCityData.Region = record[2]
-		newCityData.District = record[3]
-		newCityData.Population, err = strconv.Atoi(record[4])
-		if err != nil {
-			return err
-		}
-		newCityData.Foundation, err = strconv.Atoi(record[5])
-		if err != nil {
-			return err
-		}
-		err = DbAddCity(newCityData, db)
+	tx, dbErr := db.Begin()
+	if dbErr != nil {
+		return dbErr
+	}
+	defer tx.Rollback()
+	if dbErr = dbImportCities(cities, "system", "", tx); dbErr != nil {
+		return dbErr
+	}
+	if dbErr = dbSeedCityNames(tx); dbErr != nil { //названия ссылаются на города, поэтому добавляются после них
+		return dbErr
+	}
+	if dbErr = dbSeedDictionaryNames(tx); dbErr != nil { //регионы и округа создал импорт
+		return dbErr
+	}
+	return tx.Commit()
+}
+
+// добавляет города одной транзакцией: при ошибке любого города не добавляется ни один. Каждый импортированный
+// город записывается в журнал в той же транзакции, неизвестные регионы и округа добавляются в справочники
+func DbImportCities(cities []structs.CityInfo, actor string, requestId string, db *sql.DB) error {
+	tx, dbErr := db.Begin()
+	if dbErr != nil {
+		return dbErr
+	}
+	defer tx.Rollback()
+	if dbErr = dbImportCities(cities, actor, requestId, tx); dbErr != nil {
+		return dbErr
+	}
+	return tx.Commit()
+}
+
+func dbImportCities(cities []structs.CityInfo, actor string, requestId string, tx executor) error {
+	for i := range cities {
+		_, err := dbCityOperation(&structs.BatchOperation{Op: "import", City: &cities[i]}, actor, requestId, tx)
 		if err != nil {
-			return err
+			return fmt.Errorf("city %d: %w", cities[i].Id, err)
 		}
 	}
 	return nil
@@ -88,176 +100,646 @@ func DbNextIndex(db *sql.DB) (int, error) { //Вспомогательная ф
 	return nextId + 1, nil
 }
 
-func DbGetCityInfo(id int, db *sql.DB) ([]byte, error) {
-	request := fmt.Sprint("SELECT cityName, region, district, population, foundation FROM cityData WHERE cityID=", id)
-	resp, dbErr := db.Query(request)
+// столбцы города в порядке полей structs.CityInfo, общие для всех запросов чтения; версия строки добавляется citySelect
+const cityColumns = "cityID, cityName, region, district, population, foundation, latitude, longitude, elevation, area"
+
+// выражения полей, доступных для фильтров; {moment} - момент, на который считается возраст
+var derivedColumns = map[string]string{
+	"age":     "(extract(year from {moment})::int - foundation - (CASE WHEN foundation < 0 THEN 1 ELSE 0 END))", //нулевого года нет
+	"density": "(population / nullif(area, 0))",
+	"area":    "area",
+}
+
+// условие, скрывающее удаленные города, если они не запрошены явно
+func deletedFilter(options *structs.ReadOptions) string {
+	if options != nil && options.IncludeDeleted {
+		return ""
+	}
+	return " AND deletedAt IS NULL"
+}
+
+// запрос чтения городов с условием where. При заданном options.AsOf города берутся из истории версий
+// в том состоянии, в котором они были на этот момент. К столбцам добавляются вычисляемые возраст и плотность,
+// к условию - ограничения options.Filters
+func citySelect(options *structs.ReadOptions, where string, args ...interface{}) (string, []interface{}) {
+	source := "cityData"
+	moment := "now()"
+	if options != nil && options.AsOf != nil {
+		args = append(args, *options.AsOf)
+		moment = fmt.Sprintf("$%d::timestamptz", len(args))
+		source = fmt.Sprintf(`(SELECT (jsonb_populate_record(null::cityData, rowData)).* FROM cityDataHistory
+			WHERE validFrom<=$%[1]d AND (validTo IS NULL OR validTo>$%[1]d)) AS cityData`, len(args))
+	}
+	columns := cityColumns
+	if options != nil && len(options.Languages) > 0 {
+		args = append(args, pq.Array(options.Languages))
+		columns = localizedColumns(len(args))
+	}
+	derived := func(field string) string {
+		return strings.ReplaceAll(derivedColumns[field], "{moment}", moment)
+	}
+	columns += ", " + derived("age") + " AS age, " + derived("density") + " AS density"
+	columns += ", coalesce(version, 0) AS version" //в истории до появления версий version нет
+	if options != nil && len(options.Filters) > 0 {
+		where = "(" + where + ")"
+		for _, filter := range options.Filters {
+			if filter.Min != nil {
+				args = append(args, *filter.Min)
+				where += fmt.Sprintf(" AND %s>=$%d", derived(filter.Field), len(args))
+			}
+			if filter.Max != nil {
+				args = append(args, *filter.Max)
+				where += fmt.Sprintf(" AND %s<=$%d", derived(filter.Field), len(args))
+			}
+		}
+	}
+	return "SELECT " + columns + " FROM " + source + " WHERE " + where + deletedFilter(options), args
+}
+
+// столбцы cityColumns, в которых название, регион и округ заменены переводом на первый из языков
+// параметра $langs, для которого он есть; без перевода остается русское название
+func localizedColumns(langs int) string {
+	return fmt.Sprintf(`cityID,
+		coalesce((SELECT n.name FROM cityNames n WHERE n.cityID=cityData.cityID AND n.kind='official'
+			AND n.lang=ANY($%[1]d::text[]) ORDER BY array_position($%[1]d::text[], n.lang::text), n.id LIMIT 1), cityName) AS cityName,
+		%[2]s AS region,
+		%[3]s AS district,
+		population, foundation, latitude, longitude, elevation, area`, langs,
+		localizedName("region", "cityData.regionID", "region", langs), localizedName("district", "cityData.districtID", "district", langs))
+}
+
+// города с таким ID нет или он удалён
+var ErrNoCity = errors.New("no city with such ID was found")
+
+// восстанавливаемого города нет или он не удалён
+var ErrNoDeletedCity = errors.New("no deleted city with such ID was found")
+
+// город изменен после того, как клиент получил версию из If-Match
+var ErrVersionMismatch = errors.New("city was changed by another request, read it again")
+
+// общие методы *sql.DB и *sql.Tx: функции с таким параметром работают и отдельно, и внутри транзакции
+type executor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func dbQueryCities(db executor, request string, args ...interface{}) ([]structs.CityInfo, error) {
+	resp, dbErr := db.Query(request, args...)
 	if dbErr != nil {
 		return nil, dbErr
 	}
 	defer resp.Close()
-	if !resp.Next() {
-		return nil, errors.New("no city with such ID was found")
+	columns, dbErr := resp.Columns()
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	var cities []structs.CityInfo
+	for resp.Next() {
+		var city structs.CityInfo
+		//вычисляемые поля и расстояние есть не во всех запросах, поэтому столбцы сопоставляются по именам
+		byName := map[string]interface{}{"cityid": &city.Id, "cityname": &city.Name, "region": &city.Region,
+			"district": &city.District, "population": &city.Population, "foundation": &city.Foundation,
+			"latitude": &city.Latitude, "longitude": &city.Longitude, "elevation": &city.Elevation, "area": &city.Area,
+			"age": &city.Age, "density": &city.Density, "distance": &city.Distance, "version": &city.Version}
+		fields := make([]interface{}, len(columns))
+		for i, column := range columns {
+			field, ok := byName[strings.ToLower(column)]
+			if !ok {
+				return nil, fmt.Errorf("unexpected column %s", column)
+			}
+			fields[i] = field
+		}
+		err := resp.Scan(fields...)
+		if err != nil {
+			return nil, err
+		}
+		cities = append(cities, city)
+	}
+	return cities, resp.Err()
+}
+
+func DbGetCity(id int, options *structs.ReadOptions, db *sql.DB) (*structs.CityInfo, error) {
+	return dbGetCity(id, options, db)
+}
+
+// перечитывает города из базы с названиями на языках options.Languages, сохраняя порядок списка
+func DbLocalizeCities(cities []structs.CityInfo, options *structs.ReadOptions, db *sql.DB) ([]structs.CityInfo, error) {
+	ids := make([]int64, len(cities))
+	for i := range cities {
+		ids[i] = int64(cities[i].Id)
+	}
+	request, args := citySelect(options, "cityID=ANY($1)", pq.Array(ids))
+	localized, dbErr := dbQueryCities(db, request, args...)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	byId := make(map[int]structs.CityInfo, len(localized))
+	for _, city := range localized {
+		byId[city.Id] = city
+	}
+	result := make([]structs.CityInfo, 0, len(cities))
+	for _, city := range cities {
+		if found, ok := byId[city.Id]; ok {
+			result = append(result, found)
+		}
+	}
+	return result, nil
+}
+
+func dbGetCity(id int, options *structs.ReadOptions, db executor) (*structs.CityInfo, error) {
+	request, args := citySelect(options, "cityID=$1", id)
+	cities, dbErr := dbQueryCities(db, request, args...)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	if len(cities) == 0 {
+		return nil, ErrNoCity
+	}
+	return &cities[0], nil
+}
+
+// выполняет изменение города в отдельной транзакции вместе с записью в журнал: если запись в журнал не удалась,
+// изменение отменяется. Возвращает запись журнала с состоянием города до и после изменения
+func DbCityOperation(operation *structs.BatchOperation, actor string, requestId string, db *sql.DB) (*structs.AuditEntry, error) {
+	tx, dbErr := db.Begin()
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	defer tx.Rollback()
+	entry, dbErr := dbCityOperation(operation, actor, requestId, tx)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return entry, tx.Commit()
+}
+
+// изменение города в транзакции tx: create и import - добавление City (import добавляет неизвестные регионы
+// и округа в справочники), update - новая численность, delete - удаление, restore - восстановление города Id.
+// Строка города блокируется до чтения состояния "до", поэтому журнал не расходится с параллельными изменениями
+func dbCityOperation(operation *structs.BatchOperation, actor string, requestId string, tx executor) (*structs.AuditEntry, error) {
+	entry := &structs.AuditEntry{Actor: actor, RequestId: requestId, Action: operation.Op, CityId: operation.Id}
+	var err error
+	switch operation.Op {
+	case "create", "import":
+		if operation.Op == "create" {
+			entry.Action = "add"
+		}
+		entry.CityId, entry.After = operation.City.Id, operation.City
+		err = dbInsertCity(operation.City, operation.Op == "import", tx)
+	case "update", "delete":
+		_, err = dbLockCity(operation.Id, false, tx)
+		if err == nil {
+			entry.Before, err = dbGetCity(operation.Id, nil, tx)
+		}
+		if err == nil && operation.Op == "update" {
+			err = dbUpdatePopulation(operation.Id, operation.Population, operation.Effective, operation.Version, tx)
+			if err == nil {
+				entry.After, err = dbGetCity(operation.Id, nil, tx)
+			}
+		}
+		if err == nil && operation.Op == "delete" {
+			err = dbDeleteCity(operation.Id, operation.Version, tx)
+		}
+	case "restore":
+		err = dbRestoreCity(operation.Id, tx)
+		if err == nil {
+			entry.After, err = dbGetCity(operation.Id, nil, tx)
+		}
+	default:
+		return nil, fmt.Errorf("unknown operation %q", operation.Op)
 	}
-	cityData := new([5]string)
-	err := resp.Scan(&cityData[0], &cityData[1], &cityData[2], &cityData[3], &cityData[4])
 	if err != nil {
 		return nil, err
 	}
-	return []byte(fmt.Sprintf("%s %s %s %s %s", cityData[0], cityData[1], cityData[2], cityData[3], cityData[4])), nil
+	return entry, dbAudit(entry, tx)
 }
 
-func DbAddCity(newCity *structs.CityInfo, db *sql.DB) error {
-	request := fmt.Sprintf("INSERT INTO citydata VALUES ('%d', '%s', '%s', '%s', '%d', '%d')",
-		newCity.Id, newCity.Name, newCity.Region, newCity.District, newCity.Population, newCity.Foundation)
-	_, dbErr := db.Exec(request)
+// блокирует строку города до конца транзакции и возвращает ее версию; deleted - город, помеченный удаленным
+func dbLockCity(id int, deleted bool, tx executor) (version int, dbErr error) {
+	condition := "deletedAt IS NULL"
+	if deleted {
+		condition = "deletedAt IS NOT NULL"
+	}
+	dbErr = tx.QueryRow("SELECT version FROM cityData WHERE cityID=$1 AND "+condition+" FOR UPDATE", id).Scan(&version)
+	if dbErr == sql.ErrNoRows && deleted {
+		return 0, ErrNoDeletedCity
+	}
+	if dbErr == sql.ErrNoRows {
+		return 0, ErrNoCity
+	}
+	return version, dbErr
+}
+
+// добавление города в открытой транзакции tx; регион и округ должны быть в справочниках (при createDictionary
+// неизвестные добавляются), их названия заменяются каноническими
+func dbInsertCity(newCity *structs.CityInfo, createDictionary bool, tx executor) error {
+	var regionId, districtId int
+	var dbErr error
+	districtId, newCity.District, dbErr = dbResolveDictionary("district", newCity.District, createDictionary, tx)
+	if dbErr != nil {
+		return dbErr
+	}
+	regionId, newCity.Region, dbErr = dbResolveDictionary("region", newCity.Region, createDictionary, tx)
 	if dbErr != nil {
 		return dbErr
 	}
+	if createDictionary {
+		_, dbErr = tx.Exec("UPDATE region SET districtID=$1 WHERE id=$2 AND districtID IS NULL", districtId, regionId)
+		if dbErr != nil {
+			return dbErr
+		}
+	}
+	dbErr = dbCheckRegionDistrict(regionId, districtId, tx)
+	if dbErr != nil {
+		return dbErr
+	}
+	request := "INSERT INTO cityData (" + cityColumns + ", regionID, districtID) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)"
+	_, dbErr = tx.Exec(request, newCity.Id, newCity.Name, newCity.Region, newCity.District, newCity.Population, newCity.Foundation,
+		newCity.Latitude, newCity.Longitude, newCity.Elevation, newCity.Area, regionId, districtId)
+	if dbErr != nil {
+		return dbErr
+	}
+	if newCity.Population != nil { //неизвестная численность в историю не попадает
+		_, dbErr = tx.Exec("INSERT INTO populationHistory (cityID, effective, population, source) VALUES ($1, current_date, $2, 'initial')",
+			newCity.Id, *newCity.Population)
+		if dbErr != nil {
+			return dbErr
+		}
+	}
 	return nil
 }
 
-func DbDeleteCity(id int, db *sql.DB) error {
-	request := fmt.Sprintf("DELETE FROM citydata WHERE cityid=%d", id)
-	_, dbErr := db.Exec(request)
+// удаление только помечает город, окончательно его удаляет DbPurgeDeleted; version - ожидаемая версия строки,
+// nil - без проверки
+func dbDeleteCity(id int, version *int, tx executor) error {
+	current, dbErr := dbLockCity(id, false, tx)
 	if dbErr != nil {
 		return dbErr
 	}
-	return nil
+	if version != nil && *version != current {
+		return ErrVersionMismatch
+	}
+	_, dbErr = tx.Exec("UPDATE cityData SET deletedAt=now() WHERE cityID=$1", id)
+	return dbErr
 }
 
-func DbPopulationUpdate(id int, population *structs.NewPopulation, db *sql.DB) error {
-	request := fmt.Sprintf("update citydata set population = %d where cityid = %d", population.Value, id)
-	_, dbErr := db.Exec(request)
+// снимает с города пометку удаленного
+func dbRestoreCity(id int, tx executor) error {
+	_, dbErr := dbLockCity(id, true, tx)
 	if dbErr != nil {
 		return dbErr
 	}
-	return nil
+	_, dbErr = tx.Exec("UPDATE cityData SET deletedAt=NULL WHERE cityID=$1", id)
+	return dbErr
 }
 
-func DbListByRegion(region *structs.StringQuery, db *sql.DB) ([]byte, error) {
-	request := fmt.Sprintf("SELECT * FROM cityData WHERE region='%s'", region.Request)
-	resp, dbErr := db.Query(request)
+// окончательно удаляет города, помеченные удаленными раньше чем retention назад, и возвращает их
+func DbPurgeDeleted(retention time.Duration, db *sql.DB) ([]structs.CityInfo, error) {
+	tx, dbErr := db.Begin()
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	defer tx.Rollback()
+	purged, dbErr := dbQueryCities(tx, "DELETE FROM cityData WHERE deletedAt<$1 RETURNING "+cityColumns, time.Now().Add(-retention))
 	if dbErr != nil {
 		return nil, dbErr
 	}
+	for i := range purged {
+		dbErr = dbAudit(&structs.AuditEntry{Actor: "system", Action: "purge", CityId: purged[i].Id, Before: &purged[i]}, tx)
+		if dbErr != nil {
+			return nil, dbErr
+		}
+	}
+	return purged, tx.Commit()
+}
 
+// добавляет численность в историю в транзакции tx, текущей становится численность с самой поздней датой; version - ожидаемая версия строки
+func dbUpdatePopulation(id int, population *structs.NewPopulation, effective time.Time, version *int, tx executor) error {
+	current, dbErr := dbLockCity(id, false, tx)
+	if dbErr != nil {
+		return dbErr
+	}
+	if version != nil && *version != current {
+		return ErrVersionMismatch
+	}
+	_, dbErr = tx.Exec("INSERT INTO populationHistory (cityID, effective, population, source) VALUES ($1, $2, $3, $4)",
+		id, effective, population.Value, population.Source)
+	if dbErr != nil {
+		return dbErr
+	}
+	_, dbErr = tx.Exec(`UPDATE cityData SET population=(SELECT population FROM populationHistory
+		WHERE cityID=$1 ORDER BY effective DESC, id DESC LIMIT 1) WHERE cityID=$1`, id)
+	return dbErr
+}
+
+func DbPopulationHistory(id int, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	//город без истории дает одну строку из null, отсутствующий или удаленный - ни одной
+	resp, dbErr := db.Query(`SELECT to_char(h.effective, 'YYYY-MM-DD'), h.population, h.source FROM cityData
+		LEFT JOIN populationHistory h ON h.cityID=cityData.cityID
+		WHERE cityData.cityID=$1`+deletedFilter(options)+` ORDER BY h.effective, h.id`, id)
+	if dbErr != nil {
+		return nil, dbErr
+	}
 	defer resp.Close()
-	cityList := ""
+	found := false
+	historyList := ""
 	for resp.Next() {
-		cityData := new([6]string)
-		err := resp.Scan(&cityData[0], &cityData[1], &cityData[2], &cityData[3], &cityData[4], &cityData[5])
+		found = true
+		var effective, population, source sql.NullString
+		err := resp.Scan(&effective, &population, &source)
 		if err != nil {
 			return nil, err
 		}
-		cityList += fmt.Sprintf("%s %s %s %s %s %s\n", cityData[0], cityData[1], cityData[2], cityData[3], cityData[4], cityData[5])
+		if effective.Valid {
+			historyList += fmt.Sprintf("%s %s %s\n", effective.String, population.String, source.String)
+		}
+	}
+	if dbErr = resp.Err(); dbErr != nil {
+		return nil, dbErr
+	}
+	if !found {
+		return nil, ErrNoCity
 	}
-	if cityList == "" {
-		return []byte("No cities were found in region " + region.Request), nil
+	if historyList == "" {
+		return []byte(fmt.Sprintf("No population history was found for city with ID %d", id)), nil
 	}
-	return []byte(cityList), nil
+	return []byte(historyList), nil
 }
 
-func DbListByDistrict(district *structs.StringQuery, db *sql.DB) ([]byte, error) {
-	request := fmt.Sprintf("SELECT * FROM cityData WHERE district='%s'", district.Request)
-	resp, dbErr := db.Query(request)
+// проверяет, что город есть и не помечен удаленным (помеченные видны при options.IncludeDeleted)
+func dbCheckCity(id int, options *structs.ReadOptions, db executor) error {
+	var found int
+	dbErr := db.QueryRow("SELECT 1 FROM cityData WHERE cityID=$1"+deletedFilter(options), id).Scan(&found)
+	if dbErr == sql.ErrNoRows {
+		return ErrNoCity
+	}
+	return dbErr
+}
+
+// численность на дату: последнее известное значение не позже date
+func dbPopulationAt(id int, date time.Time, db *sql.DB) (effective time.Time, population int, dbErr error) {
+	dbErr = db.QueryRow(`SELECT effective, population FROM populationHistory
+		WHERE cityID=$1 AND effective<=$2 ORDER BY effective DESC, id DESC LIMIT 1`, id, date).Scan(&effective, &population)
+	if dbErr == sql.ErrNoRows {
+		return effective, 0, fmt.Errorf("no population data for city %d on %s", id, date.Format("2006-01-02"))
+	}
+	return effective, population, dbErr
+}
+
+// изменение численности между двумя датами: абсолютное, в процентах и среднегодовой темп роста
+func DbPopulationGrowth(id int, from time.Time, to time.Time, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	if dbErr := dbCheckCity(id, options, db); dbErr != nil {
+		return nil, dbErr
+	}
+	fromDate, fromPopulation, dbErr := dbPopulationAt(id, from, db)
 	if dbErr != nil {
 		return nil, dbErr
 	}
-
-	defer resp.Close()
-	cityList := ""
-	for resp.Next() {
-		cityData := new([6]string)
-		err := resp.Scan(&cityData[0], &cityData[1], &cityData[2], &cityData[3], &cityData[4], &cityData[5])
-		if err != nil {
-			return nil, err
+	toDate, toPopulation, dbErr := dbPopulationAt(id, to, db)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	growth := fmt.Sprintf("from %s %d to %s %d change %d", fromDate.Format("2006-01-02"), fromPopulation,
+		toDate.Format("2006-01-02"), toPopulation, toPopulation-fromPopulation)
+	if fromPopulation > 0 {
+		growth += fmt.Sprintf(" (%.2f%%)", float64(toPopulation-fromPopulation)/float64(fromPopulation)*100)
+		years := toDate.Sub(fromDate).Hours() / 24 / 365.25
+		if years > 0 {
+			growth += fmt.Sprintf(" average annual growth %.2f%%", (math.Pow(float64(toPopulation)/float64(fromPopulation), 1/years)-1)*100)
 		}
-		cityList += fmt.Sprintf("%s %s %s %s %s %s\n", cityData[0], cityData[1], cityData[2], cityData[3], cityData[4], cityData[5])
 	}
-	if cityList == "" {
-		return []byte("No cities were found in district " + district.Request), nil
+	return []byte(growth), nil
+}
+
+func DbListByRegion(region *structs.StringQuery, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	request, args := citySelect(options, "region=$1", dbCanonicalName("region", region.Request, db))
+	cities, dbErr := dbQueryCities(db, request, args...)
+	if dbErr != nil {
+		return nil, dbErr
 	}
-	return []byte(cityList), nil
+	return format.CityList(cities, options, "No cities were found in region "+region.Request)
 }
 
-func DbListByPopulation(populationRange *structs.Values, db *sql.DB) ([]byte, error) {
-	request := ""
-	if populationRange.MaxValue != 0 {
-		request = fmt.Sprintf("SELECT * FROM citydata WHERE population>=%d AND population<=%d", populationRange.MinValue, populationRange.MaxValue)
-	} else {
-		request = fmt.Sprintf("SELECT * FROM citydata WHERE population>=%d", populationRange.MinValue)
+func DbListByDistrict(district *structs.StringQuery, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	request, args := citySelect(options, "district=$1", dbCanonicalName("district", district.Request, db))
+	cities, dbErr := dbQueryCities(db, request, args...)
+	if dbErr != nil {
+		return nil, dbErr
 	}
-	resp, dbErr := db.Query(request)
+	return format.CityList(cities, options, "No cities were found in district "+district.Request)
+}
+
+// все неудаленные города в текущем состоянии (для индекса подсказок)
+func DbLoadCities(db *sql.DB) ([]structs.CityInfo, error) {
+	request, args := citySelect(nil, "true")
+	return dbQueryCities(db, request, args...)
+}
+
+// нечеткий поиск по названию, в том числе по другим названиям; сравнение выполняется в search.Rank по всем городам выборки
+func DbSearchCities(query string, limit int, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	request, args := citySelect(options, "true")
+	cities, dbErr := dbQueryCities(db, request, args...)
 	if dbErr != nil {
 		return nil, dbErr
 	}
-	defer resp.Close()
-	cityList := ""
-	for resp.Next() {
-		cityData := new([6]string)
-		err := resp.Scan(&cityData[0], &cityData[1], &cityData[2], &cityData[3], &cityData[4], &cityData[5])
-		if err != nil {
-			return nil, err
+	names, dbErr := DbAllCityNames(db)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return format.CityList(search.Rank(query, cities, names, limit), options, "No cities were found similar to "+query)
+}
+
+// города со значением column в диапазоне values или с неизвестным значением при values.Unknown
+func dbListByRange(column string, values *structs.Values, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	where := column + " IS NOT NULL"
+	empty := "No cities were found with known " + column
+	var args []interface{}
+	if values.Unknown {
+		where = column + " IS NULL"
+		empty = "No cities were found with unknown " + column
+	}
+	if values.MinValue != nil {
+		args = append(args, *values.MinValue)
+		where += fmt.Sprintf(" AND %s>=$%d", column, len(args))
+		empty += fmt.Sprintf(" from %d", *values.MinValue)
+	}
+	if values.MaxValue != nil {
+		args = append(args, *values.MaxValue)
+		where += fmt.Sprintf(" AND %s<=$%d", column, len(args))
+		empty += fmt.Sprintf(" up to %d", *values.MaxValue)
+	}
+	request, args := citySelect(options, where, args...)
+	cities, dbErr := dbQueryCities(db, request, args...)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return format.CityList(cities, options, empty)
+}
+
+func DbListByPopulation(populationRange *structs.Values, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	return dbListByRange("population", populationRange, options, db)
+}
+
+func DbListByFoundation(foundationRange *structs.Values, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	return dbListByRange("foundation", foundationRange, options, db)
+}
+
+// в резервную копию попадают только неудаленные города
+func DbBackup(db *sql.DB) error {
+	request, args := citySelect(nil, "true")
+	cities, dbErr := dbQueryCities(db, request, args...)
+	if dbErr != nil {
+		return dbErr
+	}
+	outFile, err := os.Create("cities.csv")
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	w := csv.NewWriter(outFile)
+	optional := func(value *float64) string {
+		if value == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*value, 'f', -1, 64)
+	}
+	optionalInt := func(value *int) string {
+		if value == nil {
+			return ""
 		}
-		cityList += fmt.Sprintf("%s %s %s %s %s %s\n", cityData[0], cityData[1], cityData[2], cityData[3], cityData[4], cityData[5])
+		return strconv.Itoa(*value)
 	}
-	if cityList == "" {
-		if populationRange.MaxValue != 0 {
-			return []byte(fmt.Sprintf("No cities were found with population range from %d to %d", populationRange.MinValue, populationRange.MaxValue)), nil
-		} else {
-			return []byte(fmt.Sprintf("No cities were found with population starting from %d", populationRange.MinValue)), nil
+	for _, city := range cities {
+		err = w.Write([]string{strconv.Itoa(city.Id), city.Name, city.Region, city.District,
+			optionalInt(city.Population), optionalInt(city.Foundation),
+			optional(city.Latitude), optional(city.Longitude), optional(city.Elevation), optional(city.Area)})
+		if err != nil {
+			return err
 		}
 	}
-	return []byte(cityList), nil
+	w.Flush()
+	return w.Error()
+}
+
+func DbAddApiKey(name string, keyHash string, role string, db *sql.DB) error {
+	_, dbErr := db.Exec("INSERT INTO apiKeys (keyHash, keyName, role) VALUES ($1, $2, $3)", keyHash, name, role)
+	return dbErr
 }
 
-func DbListByFoundation(foundationRange *structs.Values, db *sql.DB) ([]byte, error) {
-	request := ""
-	if foundationRange.MaxValue != 0 {
-		request = fmt.Sprintf("SELECT * FROM citydata WHERE foundation>=%d AND foundation<=%d", foundationRange.MinValue, foundationRange.MaxValue)
-	} else {
-		request = fmt.Sprintf("SELECT * FROM citydata WHERE foundation>=%d", foundationRange.MinValue)
+func DbFindApiKey(keyHash string, db *sql.DB) (name string, role string, dbErr error) {
+	dbErr = db.QueryRow("SELECT keyName, role FROM apiKeys WHERE keyHash=$1", keyHash).Scan(&name, &role)
+	if dbErr == sql.ErrNoRows {
+		return "", "", errors.New("no such API key")
 	}
-	resp, dbErr := db.Query(request)
+	return name, role, dbErr
+}
+
+func DbListApiKeys(db *sql.DB) ([]byte, error) {
+	resp, dbErr := db.Query("SELECT keyName, role, created FROM apiKeys ORDER BY keyName")
 	if dbErr != nil {
 		return nil, dbErr
 	}
 	defer resp.Close()
-	cityList := ""
+	keyList := ""
 	for resp.Next() {
-		cityData := new([6]string)
-		err := resp.Scan(&cityData[0], &cityData[1], &cityData[2], &cityData[3], &cityData[4], &cityData[5])
+		keyData := new([3]string)
+		err := resp.Scan(&keyData[0], &keyData[1], &keyData[2])
 		if err != nil {
 			return nil, err
 		}
-		cityList += fmt.Sprintf("%s %s %s %s %s %s\n", cityData[0], cityData[1], cityData[2], cityData[3], cityData[4], cityData[5])
+		keyList += fmt.Sprintf("%s %s %s\n", keyData[0], keyData[1], keyData[2])
 	}
-	if cityList == "" {
-		if foundationRange.MaxValue != 0 {
-			return []byte(fmt.Sprintf("No cities were found with foundation range from %d to %d", foundationRange.MinValue, foundationRange.MaxValue)), nil
-		} else {
-			return []byte(fmt.Sprintf("No cities were found with foundation starting from %d", foundationRange.MinValue)), nil
-		}
+	if keyList == "" {
+		return []byte("No API keys were found"), nil
 	}
-	return []byte(cityList), nil
+	return []byte(keyList), nil
 }
 
-func DbBackup(db *sql.DB) error {
-	request := "SELECT * FROM cityData"
-	resp, dbErr := db.Query(request)
+func DbDeleteApiKey(name string, db *sql.DB) error {
+	result, dbErr := db.Exec("DELETE FROM apiKeys WHERE keyName=$1", name)
 	if dbErr != nil {
 		return dbErr
 	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return errors.New("no API key with such name was found")
+	}
+	return nil
+}
+
+func auditJson(city *structs.CityInfo) (interface{}, error) {
+	if city == nil {
+		return nil, nil
+	}
+	buff, err := json.Marshal(city)
+	if err != nil {
+		return nil, err
+	}
+	return string(buff), nil
+}
+
+func dbAudit(entry *structs.AuditEntry, db executor) error {
+	before, err := auditJson(entry.Before)
+	if err != nil {
+		return err
+	}
+	after, err := auditJson(entry.After)
+	if err != nil {
+		return err
+	}
+	_, dbErr := db.Exec("INSERT INTO auditLog (actor, requestID, action, cityID, before, after) VALUES ($1, $2, $3, $4, $5, $6)",
+		entry.Actor, entry.RequestId, entry.Action, entry.CityId, before, after)
+	return dbErr
+}
+
+// страница журнала по возрастанию id; next - AfterId следующей страницы, 0 - записей больше нет
+func DbListAudit(filter *structs.AuditFilter, db *sql.DB) (list []byte, next int64, dbErr error) {
+	request := "SELECT id, changed, actor, requestID, action, cityID, coalesce(before::text, '-'), coalesce(after::text, '-') FROM auditLog WHERE id>$1"
+	args := []interface{}{filter.AfterId}
+	addCondition := func(condition string, value interface{}) {
+		args = append(args, value)
+		request += fmt.Sprintf(" AND %s$%d", condition, len(args))
+	}
+	if filter.CityId != nil {
+		addCondition("cityID=", *filter.CityId)
+	}
+	if filter.Actor != "" {
+		addCondition("actor=", filter.Actor)
+	}
+	if filter.From != nil {
+		addCondition("changed>=", *filter.From)
+	}
+	if filter.To != nil {
+		addCondition("changed<", *filter.To)
+	}
+	args = append(args, filter.Limit+1) //лишняя запись показывает, что есть следующая страница
+	request += fmt.Sprintf(" ORDER BY id LIMIT $%d", len(args))
+	resp, dbErr := db.Query(request, args...)
+	if dbErr != nil {
+		return nil, 0, dbErr
+	}
 	defer resp.Close()
-	outList := ""
-	for resp.Next() {
-		cityData := new([6]string)
-		err := resp.Scan(&cityData[0], &cityData[1], &cityData[2], &cityData[3], &cityData[4], &cityData[5])
+	var auditList strings.Builder
+	var lastId int64
+	for count := 0; resp.Next(); count++ {
+		if count == filter.Limit {
+			next = lastId
+			break
+		}
+		var id int64
+		entry := new([7]string)
+		err := resp.Scan(&id, &entry[0], &entry[1], &entry[2], &entry[3], &entry[4], &entry[5], &entry[6])
 		if err != nil {
-			return err
+			return nil, 0, err
 		}
-		outList += fmt.Sprintf("%s,%s,%s,%s,%s,%s\n", cityData[0], cityData[1], cityData[2], cityData[3], cityData[4], cityData[5])
+		fmt.Fprintf(&auditList, "%d %s %s %s %s %s %s %s\n", id, entry[0], entry[1], entry[2], entry[3], entry[4], entry[5], entry[6])
+		lastId = id
+	}
+	if dbErr = resp.Err(); dbErr != nil {
+		return nil, 0, dbErr
+	}
+	if auditList.Len() == 0 {
+		return []byte("No audit records were found"), 0, nil
 	}
-	err := os.WriteFile("cities.csv", []byte(outList), 0666)
-	return err
+	return []byte(auditList.String()), next, nil
 }
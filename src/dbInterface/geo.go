@@ -0,0 +1,71 @@
+//Геопространственные запросы к базе
+
+//Расстояния считаются по формуле гаверсинусов на сфере радиусом 6371 км. Если в базе установлено расширение PostGIS,
+//используется ST_DistanceSphere
+
+package dbInterface
+
+import (
+	"cities/src/format"
+	"cities/src/structs"
+	"database/sql"
+	"fmt"
+)
+
+var usePostGIS bool
+
+// проверяет наличие PostGIS, вызывается один раз при запуске
+func DbDetectPostGIS(db *sql.DB) (bool, error) {
+	dbErr := db.QueryRow("SELECT exists(SELECT 1 FROM pg_extension WHERE extname='postgis')").Scan(&usePostGIS)
+	return usePostGIS, dbErr
+}
+
+// выражение расстояния в км от города до точки, координаты которой переданы параметрами $lat и $lon.
+// Из-за округления подкоренное выражение для почти противоположных точек может превысить 1, поэтому
+// аргумент asin ограничивается единицей
+func distanceExpression(lat int, lon int) string {
+	if usePostGIS {
+		return fmt.Sprintf("ST_DistanceSphere(ST_MakePoint(longitude, latitude), ST_MakePoint($%d::float8, $%d::float8))/1000", lon, lat)
+	}
+	return fmt.Sprintf(`2*6371*asin(least(1, sqrt(power(sin(radians(latitude-$%[1]d)/2), 2)+
+		cos(radians($%[1]d))*cos(radians(latitude))*power(sin(radians(longitude-$%[2]d)/2), 2))))`, lat, lon)
+}
+
+// города с известными координатами и расстоянием до точки, условие и порядок применяются к результату
+func dbQueryByDistance(point *structs.GeoQuery, options *structs.ReadOptions, condition string, db *sql.DB, args ...interface{}) ([]structs.CityInfo, error) {
+	inner, innerArgs := citySelect(options, "latitude IS NOT NULL AND longitude IS NOT NULL")
+	innerArgs = append(innerArgs, point.Latitude, point.Longitude)
+	lat, lon := len(innerArgs)-1, len(innerArgs)
+	request := fmt.Sprintf("SELECT * FROM (SELECT c.*, %s AS distance FROM (%s) AS c) AS d %s",
+		distanceExpression(lat, lon), inner, fmt.Sprintf(condition, len(innerArgs)+1))
+	return dbQueryCities(db, request, append(innerArgs, args...)...)
+}
+
+func DbListByRadius(point *structs.GeoQuery, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	cities, dbErr := dbQueryByDistance(point, options, "WHERE distance<=$%d ORDER BY distance", db, point.RadiusKm)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return format.CityList(cities, options, fmt.Sprintf("No cities were found within %g km from %g %g", point.RadiusKm, point.Latitude, point.Longitude))
+}
+
+func DbListNearest(point *structs.GeoQuery, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	cities, dbErr := dbQueryByDistance(point, options, "ORDER BY distance LIMIT $%d", db, point.Count)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return format.CityList(cities, options, "No cities with known coordinates were found")
+}
+
+func DbListByBoundingBox(box *structs.BoundingBox, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	where := "latitude BETWEEN $1 AND $2 AND longitude BETWEEN $3 AND $4"
+	if box.MinLongitude > box.MaxLongitude {
+		where = "latitude BETWEEN $1 AND $2 AND (longitude>=$3 OR longitude<=$4)"
+	}
+	request, args := citySelect(options, where, box.MinLatitude, box.MaxLatitude, box.MinLongitude, box.MaxLongitude)
+	cities, dbErr := dbQueryCities(db, request, args...)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return format.CityList(cities, options, "No cities were found in the bounding box")
+}
@@ -0,0 +1,114 @@
+//Модуль работы с другими названиями городов (исторические, разговорные, на других языках)
+
+package dbInterface
+
+import (
+	"cities/src/structs"
+	"database/sql"
+	"fmt"
+)
+
+// годы действия названия в виде "1924-1991", "-1991" или "1924-"
+func validYears(from sql.NullInt64, to sql.NullInt64) string {
+	if !from.Valid && !to.Valid {
+		return "-"
+	}
+	years := "-"
+	if from.Valid {
+		years = fmt.Sprint(from.Int64) + years
+	}
+	if to.Valid {
+		years += fmt.Sprint(to.Int64)
+	}
+	return years
+}
+
+// другие названия города; город, помеченный удаленным, виден только при options.IncludeDeleted
+func DbListCityNames(cityId int, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	//город без других названий дает одну строку из null, отсутствующий или удаленный - ни одной
+	resp, dbErr := db.Query(`SELECT n.id, n.name, n.lang, n.kind, n.validFrom, n.validTo FROM cityData
+		LEFT JOIN cityNames n ON n.cityID=cityData.cityID
+		WHERE cityData.cityID=$1`+deletedFilter(options)+` ORDER BY n.validFrom NULLS LAST, n.id`, cityId)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	defer resp.Close()
+	found := false
+	nameList := ""
+	for resp.Next() {
+		found = true
+		var id sql.NullInt64
+		var name, lang, kind sql.NullString
+		var from, to sql.NullInt64
+		err := resp.Scan(&id, &name, &lang, &kind, &from, &to)
+		if err != nil {
+			return nil, err
+		}
+		if id.Valid {
+			nameList += fmt.Sprintf("%d %s %s %s %s\n", id.Int64, name.String, lang.String, kind.String, validYears(from, to))
+		}
+	}
+	if dbErr = resp.Err(); dbErr != nil {
+		return nil, dbErr
+	}
+	if !found {
+		return nil, ErrNoCity
+	}
+	if nameList == "" {
+		return []byte(fmt.Sprintf("No other names were found for city with ID %d", cityId)), nil
+	}
+	return []byte(nameList), nil
+}
+
+func DbAddCityName(name *structs.CityName, db *sql.DB) error {
+	if name.Lang == "" {
+		name.Lang = "ru"
+	}
+	dbErr := db.QueryRow(`INSERT INTO cityNames (cityID, name, lang, kind, validFrom, validTo)
+		SELECT cityID, $2, $3, $4, $5, $6 FROM cityData WHERE cityID=$1 AND deletedAt IS NULL RETURNING id`,
+		name.CityId, name.Name, name.Lang, name.Kind, name.ValidFrom, name.ValidTo).Scan(&name.Id)
+	if dbErr == sql.ErrNoRows {
+		return fmt.Errorf("no city with ID %d was found", name.CityId)
+	}
+	return dbErr
+}
+
+func DbDeleteCityName(cityId int, id int, db *sql.DB) error {
+	result, dbErr := db.Exec("DELETE FROM cityNames WHERE cityID=$1 AND id=$2", cityId, id)
+	if dbErr != nil {
+		return dbErr
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return fmt.Errorf("city %d has no name with ID %d", cityId, id)
+	}
+	return nil
+}
+
+// другие названия городов: cityID -> список названий
+func dbLoadCityNames(db *sql.DB, where string, args ...interface{}) (map[int][]string, error) {
+	resp, dbErr := db.Query("SELECT cityID, name FROM cityNames WHERE "+where+" ORDER BY id", args...)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	defer resp.Close()
+	names := make(map[int][]string)
+	for resp.Next() {
+		var cityId int
+		var name string
+		err := resp.Scan(&cityId, &name)
+		if err != nil {
+			return nil, err
+		}
+		names[cityId] = append(names[cityId], name)
+	}
+	return names, resp.Err()
+}
+
+func DbAllCityNames(db *sql.DB) (map[int][]string, error) {
+	return dbLoadCityNames(db, "true")
+}
+
+func DbCityNames(cityId int, db *sql.DB) ([]string, error) {
+	names, dbErr := dbLoadCityNames(db, "cityID=$1", cityId)
+	return names[cityId], dbErr
+}
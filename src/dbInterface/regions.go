@@ -0,0 +1,442 @@
+//Справочники регионов и федеральных округов
+
+//Города ссылаются на регион (regionID) и федеральный округ (districtID); текстовые поля region и district cityData
+//хранят каноническое название из справочника и обновляются при его переименовании, а округ городов - при переносе
+//региона в другой округ. Каждый измененный при этом город записывается в журнал изменений.
+//Названия сравниваются в нормализованном виде (NormalizeName), поэтому "Свердловская обл." и "свердловская область"
+//относятся к одному региону
+
+package dbInterface
+
+import (
+	"cities/src/structs"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// распространенные сокращения и их полные формы
+var abbreviations = map[string]string{
+	"обл":         "область",
+	"обл.":        "область",
+	"респ":        "республика",
+	"респ.":       "республика",
+	"ао":          "автономный округ",
+	"а.о.":        "автономный округ",
+	"фо":          "",
+	"федеральный": "",
+}
+
+// нормализованное название: нижний регистр, е вместо ё, без лишних пробелов, сокращения раскрыты,
+// слова "федеральный округ" и "ФО" отброшены
+func NormalizeName(name string) string {
+	name = strings.ReplaceAll(strings.ToLower(name), "ё", "е")
+	var words []string
+	for _, word := range strings.Fields(name) {
+		if full, ok := abbreviations[word]; ok {
+			word = full
+		}
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	normalized := strings.Join(words, " ")
+	return strings.TrimSuffix(normalized, " округ")
+}
+
+// таблица справочника: region или federalDistrict
+func dictionaryTable(kind string) string {
+	if kind == "district" {
+		return "federalDistrict"
+	}
+	return "region"
+}
+
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// находит запись справочника по названию или коду, при create=true создает ее, если не нашлась
+func dbResolveDictionary(kind string, name string, create bool, db queryer) (id int, canonical string, dbErr error) {
+	table := dictionaryTable(kind)
+	normalized := NormalizeName(name)
+	dbErr = db.QueryRow("SELECT id, name FROM "+table+" WHERE normName=$1 OR code=$2", normalized, name).Scan(&id, &canonical)
+	if dbErr == sql.ErrNoRows {
+		if !create {
+			return 0, "", fmt.Errorf("unknown %s %s", kind, name)
+		}
+		canonical = strings.Join(strings.Fields(name), " ")
+		dbErr = db.QueryRow("INSERT INTO "+table+" (name, normName) VALUES ($1, $2) RETURNING id", canonical, normalized).Scan(&id)
+	}
+	return id, canonical, dbErr
+}
+
+// каноническое название региона или округа для поиска; неизвестное название возвращается как есть
+func dbCanonicalName(kind string, name string, db *sql.DB) string {
+	_, canonical, dbErr := dbResolveDictionary(kind, name, false, db)
+	if dbErr != nil {
+		return name
+	}
+	return canonical
+}
+
+// перевод названия name записи справочника kind с идентификатором id на первый из языков параметра $langs,
+// для которого он есть; без перевода остается русское название
+func localizedName(kind string, id string, name string, langs int) string {
+	return fmt.Sprintf(`coalesce((SELECT l.name FROM localizedNames l WHERE l.kind='%[1]s' AND l.itemID=%[2]s
+			AND l.lang=ANY($%[4]d::text[]) ORDER BY array_position($%[4]d::text[], l.lang::text) LIMIT 1), %[3]s)`, kind, id, name, langs)
+}
+
+// список регионов с названиями на языках languages (пустой список - русские названия)
+func DbListRegions(languages []string, db *sql.DB) ([]byte, error) {
+	resp, dbErr := db.Query(`SELECT r.id, coalesce(r.code, '-'), `+localizedName("region", "r.id", "r.name", 1)+`,
+		coalesce(`+localizedName("district", "d.id", "d.name", 1)+`, '-') FROM region r
+		LEFT JOIN federalDistrict d ON d.id=r.districtID ORDER BY r.name`, pq.Array(languages))
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	defer resp.Close()
+	regionList := ""
+	for resp.Next() {
+		regionData := new([4]string)
+		err := resp.Scan(&regionData[0], &regionData[1], &regionData[2], &regionData[3])
+		if err != nil {
+			return nil, err
+		}
+		regionList += fmt.Sprintf("%s %s %s %s\n", regionData[0], regionData[1], regionData[2], regionData[3])
+	}
+	if regionList == "" {
+		return []byte("No regions were found"), nil
+	}
+	return []byte(regionList), nil
+}
+
+func DbListDistricts(languages []string, db *sql.DB) ([]byte, error) {
+	resp, dbErr := db.Query(`SELECT id, coalesce(code, '-'), `+localizedName("district", "id", "name", 1)+`
+		FROM federalDistrict ORDER BY name`, pq.Array(languages))
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	defer resp.Close()
+	districtList := ""
+	for resp.Next() {
+		districtData := new([3]string)
+		err := resp.Scan(&districtData[0], &districtData[1], &districtData[2])
+		if err != nil {
+			return nil, err
+		}
+		districtList += fmt.Sprintf("%s %s %s\n", districtData[0], districtData[1], districtData[2])
+	}
+	if districtList == "" {
+		return []byte("No federal districts were found"), nil
+	}
+	return []byte(districtList), nil
+}
+
+func DbGetDictionaryItem(kind string, id int, languages []string, db *sql.DB) (*structs.DictionaryItem, error) {
+	item := new(structs.DictionaryItem)
+	request := "SELECT id, coalesce(code, ''), " + localizedName("region", "id", "name", 2) + ", districtID FROM region WHERE id=$1"
+	if kind == "district" {
+		request = "SELECT id, coalesce(code, ''), " + localizedName("district", "id", "name", 2) + ", null FROM federalDistrict WHERE id=$1"
+	}
+	dbErr := db.QueryRow(request, id, pq.Array(languages)).Scan(&item.Id, &item.Code, &item.Name, &item.DistrictId)
+	if dbErr == sql.ErrNoRows {
+		return nil, fmt.Errorf("no %s with such ID was found", kind)
+	}
+	return item, dbErr
+}
+
+func nullableCode(code string) interface{} {
+	if code == "" {
+		return nil
+	}
+	return code
+}
+
+func DbAddDictionaryItem(kind string, item *structs.DictionaryItem, db *sql.DB) error {
+	if kind == "district" {
+		return db.QueryRow("INSERT INTO federalDistrict (code, name, normName) VALUES ($1, $2, $3) RETURNING id",
+			nullableCode(item.Code), item.Name, NormalizeName(item.Name)).Scan(&item.Id)
+	}
+	return db.QueryRow("INSERT INTO region (code, name, normName, districtID) VALUES ($1, $2, $3, $4) RETURNING id",
+		nullableCode(item.Code), item.Name, NormalizeName(item.Name), item.DistrictId).Scan(&item.Id)
+}
+
+// изменяет города, выбранные условием where, функцией update в транзакции tx и записывает в журнал
+// с действием action каждый город, строка которого изменилась (изменение увеличивает версию строки)
+func dbRewriteCities(where string, args []interface{}, update func() error, action string, actor string, requestId string, tx executor) error {
+	options := &structs.ReadOptions{IncludeDeleted: true} //удаленные города тоже меняются и попадают в журнал
+	request, args := citySelect(options, where, args...)
+	before, dbErr := dbQueryCities(tx, request, args...)
+	if dbErr != nil {
+		return dbErr
+	}
+	if dbErr = update(); dbErr != nil {
+		return dbErr
+	}
+	ids := make([]int, len(before))
+	for i := range before {
+		ids[i] = before[i].Id
+	}
+	//условие where могло перестать выполняться после изменения, поэтому города перечитываются по ID
+	request, args = citySelect(options, "cityID=ANY($1)", pq.Array(ids))
+	after, dbErr := dbQueryCities(tx, request, args...)
+	if dbErr != nil {
+		return dbErr
+	}
+	byId := make(map[int]*structs.CityInfo, len(after))
+	for i := range after {
+		byId[after[i].Id] = &after[i]
+	}
+	for i := range before {
+		changed := byId[before[i].Id]
+		if changed == nil || changed.Version == before[i].Version {
+			continue
+		}
+		dbErr = dbAudit(&structs.AuditEntry{Actor: actor, RequestId: requestId, Action: action, CityId: before[i].Id,
+			Before: &before[i], After: changed}, tx)
+		if dbErr != nil {
+			return dbErr
+		}
+	}
+	return nil
+}
+
+// изменение записи справочника; новое название переносится во все города, ссылающиеся на запись,
+// новый округ региона - во все города региона
+func DbUpdateDictionaryItem(kind string, item *structs.DictionaryItem, actor string, requestId string, db *sql.DB) error {
+	tx, dbErr := db.Begin()
+	if dbErr != nil {
+		return dbErr
+	}
+	defer tx.Rollback()
+	var result sql.Result
+	if kind == "district" {
+		result, dbErr = tx.Exec("UPDATE federalDistrict SET code=$1, name=$2, normName=$3 WHERE id=$4",
+			nullableCode(item.Code), item.Name, NormalizeName(item.Name), item.Id)
+	} else {
+		result, dbErr = tx.Exec("UPDATE region SET code=$1, name=$2, normName=$3, districtID=$4 WHERE id=$5",
+			nullableCode(item.Code), item.Name, NormalizeName(item.Name), item.DistrictId, item.Id)
+	}
+	if dbErr != nil {
+		return dbErr
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return fmt.Errorf("no %s with such ID was found", kind)
+	}
+	dbErr = dbRewriteCities(kind+"ID=$1", []interface{}{item.Id}, func() error {
+		_, err := tx.Exec("UPDATE cityData SET "+kind+"=$1 WHERE "+kind+"ID=$2 AND "+kind+"<>$1", item.Name, item.Id)
+		if err != nil || kind == "district" || item.DistrictId == nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE cityData SET districtID=d.id, district=d.name FROM federalDistrict d
+			WHERE d.id=$1 AND cityData.regionID=$2 AND cityData.districtID IS DISTINCT FROM d.id`, *item.DistrictId, item.Id)
+		return err
+	}, "dictionary", actor, requestId, tx)
+	if dbErr != nil {
+		return dbErr
+	}
+	return tx.Commit()
+}
+
+// удаление записи справочника, на которую ссылаются города, запрещено внешним ключом
+func DbDeleteDictionaryItem(kind string, id int, db *sql.DB) error {
+	tx, dbErr := db.Begin()
+	if dbErr != nil {
+		return dbErr
+	}
+	defer tx.Rollback()
+	result, dbErr := tx.Exec("DELETE FROM "+dictionaryTable(kind)+" WHERE id=$1", id)
+	if dbErr != nil {
+		return dbErr
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return fmt.Errorf("no %s with such ID was found", kind)
+	}
+	_, dbErr = tx.Exec("DELETE FROM localizedNames WHERE kind=$1 AND itemID=$2", kind, id)
+	if dbErr != nil {
+		return dbErr
+	}
+	return tx.Commit()
+}
+
+// переводы названия записи справочника: строка "язык название" на перевод
+func DbListDictionaryNames(kind string, id int, db *sql.DB) ([]byte, error) {
+	resp, dbErr := db.Query("SELECT lang, name FROM localizedNames WHERE kind=$1 AND itemID=$2 ORDER BY lang", kind, id)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	defer resp.Close()
+	nameList := ""
+	for resp.Next() {
+		var lang, name string
+		err := resp.Scan(&lang, &name)
+		if err != nil {
+			return nil, err
+		}
+		nameList += fmt.Sprintf("%s %s\n", lang, name)
+	}
+	if nameList == "" {
+		return []byte(fmt.Sprintf("No translations were found for %s with ID %d", kind, id)), nil
+	}
+	return []byte(nameList), nil
+}
+
+// добавляет или заменяет перевод названия записи справочника
+func DbSetDictionaryName(kind string, id int, lang string, name string, db *sql.DB) error {
+	result, dbErr := db.Exec(`INSERT INTO localizedNames (kind, itemID, lang, name)
+		SELECT $1, id, $3, $4 FROM `+dictionaryTable(kind)+` WHERE id=$2
+		ON CONFLICT (kind, itemID, lang) DO UPDATE SET name=excluded.name`, kind, id, lang, name)
+	if dbErr != nil {
+		return dbErr
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return fmt.Errorf("no %s with such ID was found", kind)
+	}
+	return nil
+}
+
+func DbDeleteDictionaryName(kind string, id int, lang string, db *sql.DB) error {
+	result, dbErr := db.Exec("DELETE FROM localizedNames WHERE kind=$1 AND itemID=$2 AND lang=$3", kind, id, lang)
+	if dbErr != nil {
+		return dbErr
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return fmt.Errorf("%s %d has no %s translation", kind, id, lang)
+	}
+	return nil
+}
+
+// варианты написания одного названия и число городов с каждым из них
+type nameVariants map[string]int
+
+// каноническое название группы: самое частое написание, при равенстве - самое длинное (без сокращений)
+func (variants nameVariants) canonical() string {
+	names := make([]string, 0, len(variants))
+	for name := range variants {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if variants[names[i]] != variants[names[j]] {
+			return variants[names[i]] > variants[names[j]]
+		}
+		if len([]rune(names[i])) != len([]rune(names[j])) {
+			return len([]rune(names[i])) > len([]rune(names[j]))
+		}
+		return names[i] < names[j]
+	})
+	return names[0]
+}
+
+// переносит текстовые регионы и округа городов в справочники. Одинаковые после нормализации названия объединяются,
+// в отчет попадает каждое объединенное написание, в журнал - каждый измененный город
+func DbMigrateRegions(actor string, requestId string, db *sql.DB) ([]byte, error) {
+	tx, dbErr := db.Begin()
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	defer tx.Rollback()
+	groups := map[string]map[string]nameVariants{"region": {}, "district": {}}
+	regionDistricts := make(map[string]nameVariants) //округа, в которых встречаются города региона
+	resp, dbErr := tx.Query("SELECT region, district, count(*) FROM cityData GROUP BY region, district")
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	for resp.Next() {
+		var region, district string
+		var count int
+		if err := resp.Scan(&region, &district, &count); err != nil {
+			resp.Close()
+			return nil, err
+		}
+		for kind, name := range map[string]string{"region": region, "district": district} {
+			key := NormalizeName(name)
+			if groups[kind][key] == nil {
+				groups[kind][key] = nameVariants{}
+			}
+			groups[kind][key][name] += count
+		}
+		if regionDistricts[NormalizeName(region)] == nil {
+			regionDistricts[NormalizeName(region)] = nameVariants{}
+		}
+		regionDistricts[NormalizeName(region)][NormalizeName(district)] += count
+	}
+	resp.Close()
+	if dbErr = resp.Err(); dbErr != nil {
+		return nil, dbErr
+	}
+
+	report := ""
+	dbErr = dbRewriteCities("true", nil, func() error {
+		return dbMergeDictionaries(groups, regionDistricts, &report, tx)
+	}, "migrate", actor, requestId, tx)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	if dbErr = dbSeedDictionaryNames(tx); dbErr != nil { //переводы ссылаются на созданные записи справочников
+		return nil, dbErr
+	}
+	if dbErr = tx.Commit(); dbErr != nil {
+		return nil, dbErr
+	}
+	if report == "" {
+		report = "No duplicate regions or districts were found\n"
+	}
+	return []byte(report), nil
+}
+
+// создает записи справочников для групп написаний и переводит на них города
+func dbMergeDictionaries(groups map[string]map[string]nameVariants, regionDistricts map[string]nameVariants, report *string, tx executor) error {
+	for _, kind := range []string{"district", "region"} {
+		keys := make([]string, 0, len(groups[kind]))
+		for key := range groups[kind] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			variants := groups[kind][key]
+			canonical := variants.canonical()
+			id, canonical, dbErr := dbResolveDictionary(kind, canonical, true, tx)
+			if dbErr != nil {
+				return dbErr
+			}
+			if kind == "region" {
+				districtId, _, dbErr := dbResolveDictionary("district", regionDistricts[key].canonical(), false, tx)
+				if dbErr != nil {
+					return dbErr
+				}
+				_, dbErr = tx.Exec("UPDATE region SET districtID=$1 WHERE id=$2 AND districtID IS NULL", districtId, id)
+				if dbErr != nil {
+					return dbErr
+				}
+			}
+			for name, count := range variants {
+				_, dbErr = tx.Exec("UPDATE cityData SET "+kind+"=$1, "+kind+"ID=$2 WHERE "+kind+"=$3", canonical, id, name)
+				if dbErr != nil {
+					return dbErr
+				}
+				if name != canonical {
+					*report += fmt.Sprintf("%s \"%s\" merged into \"%s\" (%d cities)\n", kind, name, canonical, count)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// проверка, что регион города относится к указанному округу
+func dbCheckRegionDistrict(regionId int, districtId int, db queryer) error {
+	var regionDistrict sql.NullInt64
+	dbErr := db.QueryRow("SELECT districtID FROM region WHERE id=$1", regionId).Scan(&regionDistrict)
+	if dbErr != nil {
+		return dbErr
+	}
+	if regionDistrict.Valid && int(regionDistrict.Int64) != districtId {
+		return errors.New("region belongs to another federal district")
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+//Начальные переводы и исторические названия
+
+//Другие названия ссылаются на города и записи справочников, поэтому добавляются не схемой базы, а после появления
+//городов: при первоначальном заполнении из cities.csv (DbFillFromCsv), которое создает и записи справочников,
+//при каждом запуске узла основной базы (DbSeedNames) - так названия получают и базы, обновленные скриптом
+//progreSQL.sql, - а переводы регионов и округов также при переносе городов в справочники (DbMigrateRegions).
+//Уже добавленные названия не дублируются, названия городов и записей, которых нет в базе, пропускаются
+
+package dbInterface
+
+import "database/sql"
+
+// ключ блокировки, под которой узлы основной базы добавляют названия по очереди
+const seedLockKey = 4301
+
+// добавляет недостающие исторические и английские названия городов, регионов и округов
+func DbSeedNames(db *sql.DB) error {
+	tx, dbErr := db.Begin()
+	if dbErr != nil {
+		return dbErr
+	}
+	defer tx.Rollback()
+	//у cityNames нет уникального ключа, поэтому одновременный запуск нескольких узлов продублировал бы названия
+	if _, dbErr = tx.Exec("SELECT pg_advisory_xact_lock($1)", seedLockKey); dbErr != nil {
+		return dbErr
+	}
+	if dbErr = dbSeedCityNames(tx); dbErr != nil {
+		return dbErr
+	}
+	if dbErr = dbSeedDictionaryNames(tx); dbErr != nil {
+		return dbErr
+	}
+	return tx.Commit()
+}
+
+// историческое название города; ValidFrom и ValidTo - годы действия
+type historicalName struct {
+	City      string
+	Name      string
+	ValidFrom int
+	ValidTo   int
+}
+
+var historicalNames = []historicalName{
+	{"Екатеринбург", "Свердловск", 1924, 1991},
+	{"Самара", "Куйбышев", 1935, 1991},
+	{"Санкт-Петербург", "Петроград", 1914, 1924},
+	{"Санкт-Петербург", "Ленинград", 1924, 1991},
+	{"Нижний Новгород", "Горький", 1932, 1990},
+	{"Волгоград", "Царицын", 1589, 1925},
+	{"Волгоград", "Сталинград", 1925, 1961},
+	{"Тольятти", "Ставрополь", 1737, 1964},
+	{"Киров", "Вятка", 1780, 1934},
+	{"Калининград", "Кёнигсберг", 1255, 1946},
+}
+
+// английские названия городов
+var englishCityNames = map[string]string{
+	"Москва": "Moscow", "Санкт-Петербург": "Saint Petersburg", "Екатеринбург": "Yekaterinburg",
+	"Нижний Новгород": "Nizhny Novgorod", "Самара": "Samara", "Челябинск": "Chelyabinsk",
+	"Ростов-на-Дону": "Rostov-on-Don", "Уфа": "Ufa", "Волгоград": "Volgograd", "Пермь": "Perm",
+	"Воронеж": "Voronezh", "Саратов": "Saratov", "Краснодар": "Krasnodar", "Тольятти": "Tolyatti",
+	"Ижевск": "Izhevsk", "Ульяновск": "Ulyanovsk", "Владивосток": "Vladivostok", "Ярославль": "Yaroslavl",
+	"Тюмень": "Tyumen", "Махачкала": "Makhachkala", "Хабаровск": "Khabarovsk", "Оренбург": "Orenburg",
+	"Казань": "Kazan", "Новосибирск": "Novosibirsk", "Омск": "Omsk", "Красноярск": "Krasnoyarsk",
+	"Барнаул": "Barnaul", "Иркутск": "Irkutsk", "Новокузнецк": "Novokuznetsk", "Кемерово": "Kemerovo",
+}
+
+// английские названия записей справочников по виду и нормализованному названию
+var englishDictionaryNames = map[string]map[string]string{
+	"district": {
+		"центральный":       "Central",
+		"северо-западный":   "Northwestern",
+		"южный":             "Southern",
+		"северо-кавказский": "North Caucasian",
+		"приволжский":       "Volga",
+		"уральский":         "Ural",
+		"сибирский":         "Siberian",
+		"дальневосточный":   "Far Eastern",
+	},
+	"region": {
+		"москва":          "Moscow",
+		"санкт-петербург": "Saint Petersburg",
+	},
+}
+
+// добавляет исторические и английские официальные названия городов, которые есть в базе
+func dbSeedCityNames(tx executor) error {
+	const insert = `INSERT INTO cityNames (cityID, name, lang, kind, validFrom, validTo)
+		SELECT cityID, $2, $3, $4, $5::int, $6::int FROM cityData WHERE cityName=$1
+		AND NOT EXISTS (SELECT 1 FROM cityNames n WHERE n.cityID=cityData.cityID AND n.name=$2 AND n.lang=$3)`
+	for _, name := range historicalNames {
+		_, dbErr := tx.Exec(insert, name.City, name.Name, "ru", "historical", name.ValidFrom, name.ValidTo)
+		if dbErr != nil {
+			return dbErr
+		}
+	}
+	for city, name := range englishCityNames {
+		_, dbErr := tx.Exec(insert, city, name, "en", "official", nil, nil)
+		if dbErr != nil {
+			return dbErr
+		}
+	}
+	return nil
+}
+
+// добавляет английские названия регионов и округов, которые есть в справочниках, не заменяя заданные ранее
+func dbSeedDictionaryNames(tx executor) error {
+	for kind, names := range englishDictionaryNames {
+		for normName, name := range names {
+			_, dbErr := tx.Exec(`INSERT INTO localizedNames (kind, itemID, lang, name)
+				SELECT $1, id, 'en', $3 FROM `+dictionaryTable(kind)+` WHERE normName=$2
+				ON CONFLICT (kind, itemID, lang) DO NOTHING`, kind, normName, name)
+			if dbErr != nil {
+				return dbErr
+			}
+		}
+	}
+	return nil
+}
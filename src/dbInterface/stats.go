@@ -0,0 +1,104 @@
+//Статистические запросы к базе
+
+package dbInterface
+
+import (
+	"cities/src/structs"
+	"database/sql"
+	"fmt"
+	"math"
+
+	"github.com/lib/pq"
+)
+
+// столбцы, по которым допускается группировка
+var statsGroups = map[string]string{"region": "region", "district": "district"}
+
+// число городов, суммарная, средняя и медианная численность, старейший и самый молодой город по группам
+func DbGroupStats(group string, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	column, ok := statsGroups[group]
+	if !ok {
+		return nil, fmt.Errorf("unknown group %s, expected region or district", group)
+	}
+	inner, args := citySelect(options, "true")
+	//города с неизвестными численностью или годом основания учитываются только в count, "-" - значений нет
+	request := fmt.Sprintf(`SELECT %[1]s, count(*), coalesce(sum(population)::text, '-'), coalesce(round(avg(population))::text, '-'),
+		coalesce((percentile_cont(0.5) WITHIN GROUP (ORDER BY population))::text, '-'),
+		coalesce((array_agg(cityName || ' ' || foundation ORDER BY foundation, cityID) FILTER (WHERE foundation IS NOT NULL))[1], '-'),
+		coalesce((array_agg(cityName || ' ' || foundation ORDER BY foundation DESC, cityID) FILTER (WHERE foundation IS NOT NULL))[1], '-')
+		FROM (%[2]s) AS c GROUP BY %[1]s ORDER BY %[1]s`, column, inner)
+	resp, dbErr := db.Query(request, args...)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	defer resp.Close()
+	statsList := ""
+	for resp.Next() {
+		statsData := new([7]string)
+		err := resp.Scan(&statsData[0], &statsData[1], &statsData[2], &statsData[3], &statsData[4], &statsData[5], &statsData[6])
+		if err != nil {
+			return nil, err
+		}
+		statsList += fmt.Sprintf("%s: cities %s, population total %s average %s median %s, oldest %s, youngest %s\n",
+			statsData[0], statsData[1], statsData[2], statsData[3], statsData[4], statsData[5], statsData[6])
+	}
+	if statsList == "" {
+		return []byte("No cities were found"), nil
+	}
+	return []byte(statsList), nil
+}
+
+// распределение городов с известной численностью; bounds - возрастающие границы интервалов
+func DbPopulationHistogram(bounds []int, options *structs.ReadOptions, db *sql.DB) ([]byte, error) {
+	inner, args := citySelect(options, "population IS NOT NULL")
+	args = append(args, pq.Array(bounds))
+	request := fmt.Sprintf("SELECT width_bucket(population, $%d::int[]) AS bucket, count(*) FROM (%s) AS c GROUP BY bucket",
+		len(args), inner)
+	resp, dbErr := db.Query(request, args...)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	defer resp.Close()
+	//интервал i: [bounds[i-1], bounds[i]), нулевой - ниже первой границы, последний - от последней границы
+	counts := make([]int, len(bounds)+1)
+	for resp.Next() {
+		var bucket, count int
+		err := resp.Scan(&bucket, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[bucket] = count
+	}
+	if dbErr = resp.Err(); dbErr != nil {
+		return nil, dbErr
+	}
+	histogram := ""
+	for i, count := range counts {
+		from, to := "-inf", "+inf"
+		if i > 0 {
+			from = fmt.Sprint(bounds[i-1])
+		}
+		if i < len(bounds) {
+			to = fmt.Sprint(bounds[i])
+		}
+		if (i == 0 || i == len(bounds)) && count == 0 {
+			continue //пустые открытые интервалы не выводятся
+		}
+		histogram += fmt.Sprintf("[%s, %s) %d\n", from, to, count)
+	}
+	return []byte(histogram), nil
+}
+
+// границы интервалов равной ширины по логарифмической шкале: 1, 10, 100, ... до максимальной численности
+func DefaultHistogramBounds(db *sql.DB) ([]int, error) {
+	var maxPopulation sql.NullInt64
+	dbErr := db.QueryRow("SELECT max(population) FROM cityData WHERE deletedAt IS NULL").Scan(&maxPopulation)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	bounds := []int{0}
+	for bound := 1; bound <= int(maxPopulation.Int64) && bound < math.MaxInt32/10; bound *= 10 {
+		bounds = append(bounds, bound)
+	}
+	return bounds, nil
+}
@@ -0,0 +1,283 @@
+//Модуль форматов ввода и вывода списков городов
+
+//Списки выводятся текстом (строка на город) или в GeoJSON (application/geo+json): FeatureCollection, в которой
+//геометрия - точка города (null, если координаты неизвестны), а свойства - поля structs.CityInfo.
+//Импорт городов возможен из CSV (формат cities.csv) и из GeoJSON такого же вида
+
+package format
+
+import (
+	"cities/src/structs"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	Text    = "text"
+	GeoJSON = "geojson"
+)
+
+const GeoJSONContentType = "application/geo+json"
+
+// формат ответа: ?format=geojson или заголовок Accept с application/geo+json, иначе текст
+func Negotiate(r *http.Request) string {
+	if r.URL.Query().Get("format") == GeoJSON || strings.Contains(r.Header.Get("Accept"), GeoJSONContentType) {
+		return GeoJSON
+	}
+	return Text
+}
+
+func ContentType(format string) string {
+	if format == GeoJSON {
+		return GeoJSONContentType
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// возраст, площадь, плотность, координаты и расстояние выводятся, только если известны
+func extraText(city *structs.CityInfo) string {
+	geo := ""
+	if city.Age != nil {
+		geo += fmt.Sprintf(" age %d", *city.Age)
+	}
+	if city.Area != nil {
+		geo += fmt.Sprintf(" %gkm²", *city.Area)
+	}
+	if city.Density != nil {
+		geo += fmt.Sprintf(" %.0f/km²", *city.Density)
+	}
+	if city.Latitude != nil && city.Longitude != nil {
+		geo += fmt.Sprintf(" %.5f %.5f", *city.Latitude, *city.Longitude)
+	}
+	if city.Distance != nil {
+		geo += fmt.Sprintf(" %.1fkm", *city.Distance)
+	}
+	return geo
+}
+
+// неизвестное значение выводится как "?"
+func intText(value *int) string {
+	if value == nil {
+		return "?"
+	}
+	return strconv.Itoa(*value)
+}
+
+func CityText(city *structs.CityInfo) string {
+	return fmt.Sprintf("%s %s %s %s %s%s", city.Name, city.Region, city.District, intText(city.Population), intText(city.Foundation), extraText(city))
+}
+
+func cityListText(cities []structs.CityInfo) string {
+	cityList := ""
+	for i := range cities {
+		city := &cities[i]
+		cityList += fmt.Sprintf("%d %s %s %s %s %s%s", city.Id, city.Name, city.Region, city.District,
+			intText(city.Population), intText(city.Foundation), extraText(city))
+		if city.Score != nil {
+			cityList += fmt.Sprintf(" score %.2f", *city.Score)
+		}
+		if city.MatchedBy != "" {
+			cityList += " (" + city.MatchedBy + ")"
+		}
+		cityList += "\n"
+	}
+	return cityList
+}
+
+type geometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+type feature struct {
+	Type       string           `json:"type"`
+	Id         int              `json:"id"`
+	Geometry   *geometry        `json:"geometry"`
+	Properties structs.CityInfo `json:"properties"`
+}
+
+type featureCollection struct {
+	Type     string    `json:"type"`
+	Features []feature `json:"features"`
+}
+
+func FeatureCollection(cities []structs.CityInfo) ([]byte, error) {
+	collection := featureCollection{Type: "FeatureCollection", Features: []feature{}}
+	for _, city := range cities {
+		item := feature{Type: "Feature", Id: city.Id, Properties: city}
+		if city.Latitude != nil && city.Longitude != nil {
+			item.Geometry = &geometry{Type: "Point", Coordinates: []float64{*city.Longitude, *city.Latitude}}
+			if city.Elevation != nil {
+				item.Geometry.Coordinates = append(item.Geometry.Coordinates, *city.Elevation)
+			}
+		}
+		collection.Features = append(collection.Features, item)
+	}
+	return json.Marshal(collection)
+}
+
+// числовые поля, по которым можно сортировать списки; ok=false - значение неизвестно
+var sortFields = map[string]func(city *structs.CityInfo) (value float64, ok bool){
+	"population": func(city *structs.CityInfo) (float64, bool) { return optionalInt(city.Population) },
+	"foundation": func(city *structs.CityInfo) (float64, bool) { return optionalInt(city.Foundation) },
+	"age":        func(city *structs.CityInfo) (float64, bool) { return optionalInt(city.Age) },
+	"area":       func(city *structs.CityInfo) (float64, bool) { return optionalFloat(city.Area) },
+	"density":    func(city *structs.CityInfo) (float64, bool) { return optionalFloat(city.Density) },
+	"distance":   func(city *structs.CityInfo) (float64, bool) { return optionalFloat(city.Distance) },
+}
+
+func optionalInt(value *int) (float64, bool) {
+	if value == nil {
+		return 0, false
+	}
+	return float64(*value), true
+}
+
+func optionalFloat(value *float64) (float64, bool) {
+	if value == nil {
+		return 0, false
+	}
+	return *value, true
+}
+
+// допустимо ли поле сортировки: name или одно из числовых полей
+func SortField(field string) bool {
+	_, ok := sortFields[field]
+	return ok || field == "name"
+}
+
+// сортирует список по полю field; города с неизвестным значением поля идут последними
+func SortCities(cities []structs.CityInfo, field string, descending bool) {
+	if field == "name" {
+		sort.SliceStable(cities, func(i, j int) bool {
+			if descending {
+				return cities[i].Name > cities[j].Name
+			}
+			return cities[i].Name < cities[j].Name
+		})
+		return
+	}
+	value, ok := sortFields[field]
+	if !ok {
+		return
+	}
+	sort.SliceStable(cities, func(i, j int) bool {
+		a, aOk := value(&cities[i])
+		b, bOk := value(&cities[j])
+		if aOk != bOk {
+			return aOk
+		}
+		if descending {
+			return a > b
+		}
+		return a < b
+	})
+}
+
+// список городов в формате options.Format, отсортированный по options.Sort;
+// для пустого текстового списка выводится сообщение empty
+func CityList(cities []structs.CityInfo, options *structs.ReadOptions, empty string) ([]byte, error) {
+	if options != nil && options.Sort != "" {
+		SortCities(cities, options.Sort, options.Descending)
+	}
+	if options != nil && options.Format == GeoJSON {
+		return FeatureCollection(cities)
+	}
+	if len(cities) == 0 {
+		return []byte(empty), nil
+	}
+	return []byte(cityListText(cities)), nil
+}
+
+// разбор CSV вида id,name,region,district,population,foundation[,latitude,longitude,elevation]
+func ParseCsv(in io.Reader) ([]structs.CityInfo, error) {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1 //координаты есть не во всех файлах
+	var cities []structs.CityInfo
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 6 {
+			return nil, fmt.Errorf("line %d: expected at least 6 fields", len(cities)+1)
+		}
+		var newCityData structs.CityInfo
+		newCityData.Id, err = strconv.Atoi(record[0])
+		if err != nil {
+			return nil, err
+		}
+		newCityData.Name = record[1]
+		newCityData.Region = record[2]
+		newCityData.District = record[3]
+		//пустые численность и год основания - значение неизвестно
+		for i, field := range []**int{&newCityData.Population, &newCityData.Foundation} {
+			if record[4+i] == "" {
+				continue
+			}
+			value, err := strconv.Atoi(record[4+i])
+			if err != nil {
+				return nil, err
+			}
+			*field = &value
+		}
+		//расширенный формат: широта, долгота, высота и площадь, пустое значение - неизвестно
+		optional := []**float64{&newCityData.Latitude, &newCityData.Longitude, &newCityData.Elevation, &newCityData.Area}
+		for i, coordinate := range optional {
+			if len(record) <= 6+i || record[6+i] == "" {
+				continue
+			}
+			value, err := strconv.ParseFloat(record[6+i], 64)
+			if err != nil {
+				return nil, err
+			}
+			*coordinate = &value
+		}
+		cities = append(cities, newCityData)
+	}
+	return cities, nil
+}
+
+// разбор FeatureCollection; координаты точки имеют приоритет над latitude/longitude/elevation в свойствах
+func ParseGeoJson(buff []byte) ([]structs.CityInfo, error) {
+	var collection featureCollection
+	err := json.Unmarshal(buff, &collection)
+	if err != nil {
+		return nil, err
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, errors.New("GeoJSON FeatureCollection expected")
+	}
+	var cities []structs.CityInfo
+	for i, item := range collection.Features {
+		city := item.Properties
+		if city.Id == 0 {
+			city.Id = item.Id
+		}
+		if item.Geometry != nil {
+			if item.Geometry.Type != "Point" || len(item.Geometry.Coordinates) < 2 {
+				return nil, fmt.Errorf("feature %d: Point geometry expected", i)
+			}
+			longitude, latitude := item.Geometry.Coordinates[0], item.Geometry.Coordinates[1]
+			city.Longitude, city.Latitude = &longitude, &latitude
+			if len(item.Geometry.Coordinates) > 2 {
+				elevation := item.Geometry.Coordinates[2]
+				city.Elevation = &elevation
+			}
+		}
+		//вычисляемые поля при импорте не учитываются
+		city.Distance, city.Age, city.Density, city.Score, city.MatchedBy, city.Version = nil, nil, nil, nil, "", 0
+		cities = append(cities, city)
+	}
+	return cities, nil
+}
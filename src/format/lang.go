@@ -0,0 +1,67 @@
+//Выбор языка названий по заголовку Accept-Language или параметру ?lang=
+
+package format
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// язык, на котором названия хранятся в cityData
+const Original = "ru"
+
+// основная часть тега языка: "en-US" -> "en"
+func primaryTag(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	return tag
+}
+
+// языки в порядке предпочтения клиента: ?lang=en,de или Accept-Language с весами q.
+// Список обрывается на русском, так как русские названия есть всегда; пустой список - переводы не нужны
+func Languages(r *http.Request) []string {
+	type weighted struct {
+		tag    string
+		weight float64
+	}
+	var tags []weighted
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		for _, tag := range strings.Split(lang, ",") {
+			tags = append(tags, weighted{primaryTag(tag), 1})
+		}
+	} else {
+		for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+			fields := strings.Split(part, ";")
+			item := weighted{primaryTag(fields[0]), 1}
+			for _, param := range fields[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					weight, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+					if err == nil {
+						item.weight = weight
+					}
+				}
+			}
+			if item.tag != "" && item.tag != "*" && item.weight > 0 {
+				tags = append(tags, item)
+			}
+		}
+		sort.SliceStable(tags, func(i, j int) bool { return tags[i].weight > tags[j].weight })
+	}
+	var languages []string
+	seen := make(map[string]bool)
+	for _, item := range tags {
+		if item.tag == Original {
+			break
+		}
+		if item.tag != "" && !seen[item.tag] {
+			seen[item.tag] = true
+			languages = append(languages, item.tag)
+		}
+	}
+	return languages
+}
@@ -0,0 +1,188 @@
+//Обработчик пакетного изменения городов
+
+package handlers
+
+import (
+	"cities/src/auth"
+	"cities/src/cache"
+	"cities/src/dbInterface"
+	"cities/src/structs"
+	"cities/src/suggest"
+	"cities/src/validate"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// наибольшее число операций в одном пакете
+const MAXBATCHSIZE = 1000
+
+const (
+	batchAtomic  = "atomic"
+	batchPerItem = "per_item"
+)
+
+// результат операции пакета; Status - http-код, который вернул бы отдельный запрос
+type batchResult struct {
+	Index      int                 `json:"index"`
+	Op         string              `json:"op"`
+	Id         int                 `json:"id,omitempty"`
+	Status     int                 `json:"status"`
+	Error      string              `json:"error,omitempty"`
+	Violations validate.Violations `json:"violations,omitempty"`
+}
+
+// проверка операции пакета; удаление, как и DELETE /cities/{id}, доступно только администратору.
+// При requireIfMatch изменение и удаление без version отклоняются с 428, как отдельные запросы без If-Match
+func checkBatchOperation(operation *structs.BatchOperation, role auth.Role, requireIfMatch bool) (int, validate.Violations) {
+	var v validate.Violations
+	switch operation.Op {
+	case "create":
+		if operation.City == nil {
+			return http.StatusUnprocessableEntity, validate.Violations{{Field: "city", Message: "is required for create"}}
+		}
+		operation.Id = operation.City.Id
+		v = validate.City(operation.City)
+	case "update":
+		if operation.Population == nil {
+			return http.StatusUnprocessableEntity, validate.Violations{{Field: "population", Message: "is required for update"}}
+		}
+		v = validate.Population(operation.Population)
+		operation.Effective = effectiveDate(operation.Population)
+	case "delete":
+		if role < auth.Admin {
+			return http.StatusForbidden, nil
+		}
+	default:
+		return http.StatusUnprocessableEntity, validate.Violations{{Field: "op", Message: "must be create, update or delete"}}
+	}
+	if operation.Op != "create" && operation.Id <= 0 {
+		v = append(v, validate.Violation{Field: "id", Message: "must be positive"})
+	}
+	if len(v) > 0 {
+		return http.StatusUnprocessableEntity, v
+	}
+	if requireIfMatch && operation.Op != "create" && operation.Version == nil {
+		return http.StatusPreconditionRequired, nil
+	}
+	return 0, nil
+}
+
+// POST /cities/batch: {"mode": "atomic"|"per_item", "operations": [{"op": "create", "city": {...}},
+// {"op": "update", "id": 1, "population": {...}, "version": 3}, {"op": "delete", "id": 2}]}; version - как If-Match.
+// В ответе - результат каждой операции; в режиме atomic ошибка любой операции отменяет весь пакет.
+// requireIfMatch - настройка RequireIfMatch: update и delete без version не выполняются (428)
+func BatchCities(db *sql.DB, c *cache.Cache, s *suggest.Index, requireIfMatch bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batch := new(structs.BatchRequest)
+		if !decodeBody(w, r, batch) {
+			return
+		}
+		if batch.Mode == "" {
+			batch.Mode = batchAtomic
+		}
+		if batch.Mode != batchAtomic && batch.Mode != batchPerItem {
+			outViolations(w, validate.Violations{{Field: "mode", Message: "must be atomic or per_item"}})
+			return
+		}
+		if len(batch.Operations) == 0 || len(batch.Operations) > MAXBATCHSIZE {
+			outViolations(w, validate.Violations{{Field: "operations", Message: fmt.Sprintf("must contain from 1 to %d operations", MAXBATCHSIZE)}})
+			return
+		}
+		identity, _ := auth.FromContext(r.Context())
+		atomic := batch.Mode == batchAtomic
+		results := make([]batchResult, len(batch.Operations))
+		var valid []structs.BatchOperation
+		var validIndex []int
+		failed := false
+		for i := range batch.Operations {
+			operation := &batch.Operations[i]
+			status, violations := checkBatchOperation(operation, identity.Role, requireIfMatch)
+			results[i] = batchResult{Index: i, Op: operation.Op, Id: operation.Id, Status: status, Violations: violations}
+			switch status {
+			case http.StatusForbidden:
+				results[i].Error = "delete requires admin role"
+			case http.StatusPreconditionRequired:
+				results[i].Error = "version of the city is required"
+			}
+			if status != 0 {
+				failed = true
+				continue
+			}
+			valid = append(valid, *operation)
+			validIndex = append(validIndex, i)
+		}
+		if atomic && failed {
+			skipBatch(results, "not executed: batch has invalid operations")
+			outBatch(w, http.StatusUnprocessableEntity, false, results)
+			return
+		}
+		var opErrs []error
+		var err error
+		if len(valid) > 0 {
+			opErrs, err = dbInterface.DbBatch(valid, atomic, auth.Actor(r), middleware.GetReqID(r.Context()), db)
+			if err != nil {
+				outError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		applied := false
+		for j, opErr := range opErrs {
+			result := &results[validIndex[j]]
+			switch {
+			case opErr == nil:
+				result.Status = http.StatusOK
+				if result.Op == "create" {
+					result.Status = http.StatusCreated
+				}
+				applied = true
+			case errors.Is(opErr, dbInterface.ErrNoCity):
+				result.Status, result.Error = http.StatusNotFound, opErr.Error()
+				failed = true
+			case errors.Is(opErr, dbInterface.ErrVersionMismatch):
+				result.Status, result.Error = http.StatusPreconditionFailed, opErr.Error()
+				failed = true
+			default:
+				result.Status, result.Error = http.StatusBadRequest, opErr.Error()
+				failed = true
+			}
+		}
+		if atomic && failed {
+			skipBatch(results, "rolled back: another operation of the batch failed")
+			outBatch(w, http.StatusBadRequest, false, results)
+			return
+		}
+		if applied {
+			c.Purge()
+			reloadIndex(s, db)
+		}
+		outBatch(w, http.StatusOK, applied, results)
+	}
+}
+
+// помечает операции откаченного пакета, которые сами по себе не вызвали ошибку
+func skipBatch(results []batchResult, reason string) {
+	for i := range results {
+		if results[i].Status == 0 || results[i].Status == http.StatusOK || results[i].Status == http.StatusCreated {
+			results[i].Status, results[i].Error = http.StatusFailedDependency, reason
+		}
+	}
+}
+
+func outBatch(w http.ResponseWriter, status int, committed bool, results []batchResult) {
+	outBuff, err := json.Marshal(struct {
+		Committed bool          `json:"committed"`
+		Results   []batchResult `json:"results"`
+	}{committed, results})
+	if err != nil {
+		outError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(outBuff)
+}
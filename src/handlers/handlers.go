@@ -4,7 +4,12 @@ package handlers
 
 import (
 	"database/sql"
+	"cities/src/auth"
+	"cities/src/cache"
 	"cities/src/dbInterface"
+	"cities/src/format"
+	"cities/src/suggest"
+	"cities/src/validate"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,12 +17,27 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 	"cities/src/structs"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// число результатов поиска по названию по умолчанию и наибольшее
+const (
+	DEFAULTSEARCHLIMIT = 10
+	MAXSEARCHLIMIT     = 100
+)
+
+// число записей журнала на странице по умолчанию и наибольшее
+const (
+	DEFAULTAUDITLIMIT = 100
+	MAXAUDITLIMIT     = 1000
 )
 
 func getId(r *http.Request) (int, error) {
-	query := strings.Split(r.URL.Path, "/")
-	Id, err := strconv.Atoi(query[len(query)-1])
+	Id, err := strconv.Atoi(chi.URLParam(r, "city_Id"))
 	if err != nil {
 		outErr := errors.New("ID must be of int type")
 		return Id, outErr
@@ -25,139 +45,537 @@ func getId(r *http.Request) (int, error) {
 	return Id, nil
 }
 
+// параметры чтения из строки запроса: ?include_deleted=true доступен только администраторам,
+// ?as_of= - момент времени, на который нужно получить данные
+func getReadOptions(r *http.Request) (*structs.ReadOptions, int, error) {
+	options := new(structs.ReadOptions)
+	if includeDeleted := r.URL.Query().Get("include_deleted"); includeDeleted != "" {
+		var err error
+		options.IncludeDeleted, err = strconv.ParseBool(includeDeleted)
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("include_deleted must be of bool type")
+		}
+		identity, _ := auth.FromContext(r.Context())
+		if options.IncludeDeleted && identity.Role < auth.Admin {
+			return nil, http.StatusForbidden, errors.New("include_deleted is allowed only for admins")
+		}
+	}
+	options.Format = format.Negotiate(r)
+	options.Languages = format.Languages(r)
+	var err error
+	options.AsOf, err = parseTime(r.URL.Query().Get("as_of"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if sort := r.URL.Query().Get("sort"); sort != "" {
+		options.Sort = strings.TrimPrefix(sort, "-")
+		options.Descending = strings.HasPrefix(sort, "-")
+		if !format.SortField(options.Sort) {
+			return nil, http.StatusBadRequest, errors.New("sort must be one of name, population, foundation, age, area, density, distance")
+		}
+	}
+	options.Filters, err = getFilters(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return options, http.StatusOK, nil
+}
+
+// ограничения ?min_age=&max_age=, ?min_density=&max_density=, ?min_area=&max_area=
+func getFilters(r *http.Request) ([]structs.RangeFilter, error) {
+	var filters []structs.RangeFilter
+	for _, field := range []string{"age", "density", "area"} {
+		filter := structs.RangeFilter{Field: field}
+		for _, bound := range []struct {
+			param string
+			value **float64
+		}{{"min_" + field, &filter.Min}, {"max_" + field, &filter.Max}} {
+			text := r.URL.Query().Get(bound.param)
+			if text == "" {
+				continue
+			}
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number", bound.param)
+			}
+			*bound.value = &value
+		}
+		if filter.Min != nil || filter.Max != nil {
+			filters = append(filters, filter)
+		}
+	}
+	return filters, nil
+}
+
+// ключ кэша с учетом параметров чтения
+func cacheKey(key string, options *structs.ReadOptions) string {
+	if options.IncludeDeleted {
+		key += "|deleted"
+	}
+	if options.AsOf != nil {
+		key += "|as_of:" + options.AsOf.Format(time.RFC3339Nano)
+	}
+	if len(options.Languages) > 0 {
+		key += "|lang:" + strings.Join(options.Languages, ",")
+	}
+	for _, filter := range options.Filters {
+		key += "|" + filter.Field + ":"
+		if filter.Min != nil {
+			key += fmt.Sprint(*filter.Min)
+		}
+		key += "-"
+		if filter.Max != nil {
+			key += fmt.Sprint(*filter.Max)
+		}
+	}
+	if options.Sort != "" {
+		key += fmt.Sprintf("|sort:%s:%t", options.Sort, options.Descending)
+	}
+	return key + "|" + options.Format
+}
+
+// отдает список городов в формате из options
+func outCityList(w http.ResponseWriter, r *http.Request, c *cache.Cache, key string, options *structs.ReadOptions, build func() ([]byte, error)) {
+	w.Header().Set("Content-Type", format.ContentType(options.Format))
+	outCached(w, r, c, cacheKey(key, options), build)
+}
+
 func outError(w http.ResponseWriter, status int, err error) {
-	w.WriteHeader(http.StatusBadRequest)
+	w.WriteHeader(status)
 	w.Write([]byte(err.Error()))
 }
 
-func GetCityInfo(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+// список нарушений в виде {"violations": [{"field": string, "message": string}, ...]} со статусом 422
+func outViolations(w http.ResponseWriter, violations validate.Violations) {
+	outBuff, err := json.Marshal(struct {
+		Violations validate.Violations `json:"violations"`
+	}{violations})
+	if err != nil {
+		outError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	w.Write(outBuff)
+}
+
+// ошибка разбора или проверки тела: нарушения по полям - 422, остальное - 400
+func outInputError(w http.ResponseWriter, err error) {
+	var violations validate.Violations
+	if errors.As(err, &violations) {
+		outViolations(w, violations)
+		return
+	}
+	outError(w, http.StatusBadRequest, err)
+}
+
+// дата, на которую действительна проверенная численность: Date или текущий момент
+func effectiveDate(population *structs.NewPopulation) time.Time {
+	if population.Date == "" {
+		return time.Now()
+	}
+	effective, _ := validate.ParseDate(population.Date) //формат даты уже проверен validate.Population
+	return effective
+}
+
+// параметр ?limit= от 1 до max, по умолчанию def
+func getLimit(r *http.Request, def int, max int) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > max {
+		return 0, fmt.Errorf("limit must be an integer from 1 to %d", max)
+	}
+	return limit, nil
+}
+
+// читает json-тело запроса в target без неизвестных полей; при ошибке отвечает сам и возвращает false
+func decodeBody(w http.ResponseWriter, r *http.Request, target interface{}) bool {
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err == nil {
+		err = validate.Decode(body, target)
+	}
+	if err != nil {
+		outInputError(w, err)
+		return false
+	}
+	return true
+}
+
+// отдает ответ из кэша или строит его запросом к базе. Если ETag совпадает с If-None-Match, тело не передается
+func outCached(w http.ResponseWriter, r *http.Request, c *cache.Cache, key string, build func() ([]byte, error)) {
+	outCachedTagged(w, r, c, key, func() ([]byte, string, error) {
+		outBuff, err := build()
+		return outBuff, "", err
+	})
+}
+
+// как outCached, но build может задать ETag сам; пустой ETag вычисляется по телу ответа
+func outCachedTagged(w http.ResponseWriter, r *http.Request, c *cache.Cache, key string, build func() ([]byte, string, error)) {
+	outBuff, etag, ok := c.Get(key)
+	if !ok {
+		var err error
+		outBuff, etag, err = build()
+		if err != nil {
+			outWriteError(w, err) //404 для отсутствующего города
+			return
+		}
+		if etag == "" {
+			etag = c.Set(key, outBuff)
+		} else {
+			etag = c.SetTagged(key, outBuff, etag)
+		}
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept, Accept-Language") //ответ зависит от формата и языка
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimSpace(match)
+		if match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(outBuff)
+}
+
+// выполняет изменение города от имени клиента запроса; запись в журнал делается в той же транзакции,
+// и ошибка журнала отменяет изменение
+func cityOperation(r *http.Request, operation *structs.BatchOperation, db *sql.DB) (*structs.AuditEntry, error) {
+	return dbInterface.DbCityOperation(operation, auth.Actor(r), middleware.GetReqID(r.Context()), db)
+}
+
+func GetCityInfo(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id, err := getId(r)
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		outBuff, err := dbInterface.DbGetCityInfo(id, db)
+		options, status, err := getReadOptions(r)
 		if err != nil {
-			outError(w, http.StatusBadRequest, err)
+			outError(w, status, err)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(outBuff)
+		//ETag содержит версию строки города, его можно передать в If-Match при изменении и удалении
+		outCachedTagged(w, r, c, cacheKey(fmt.Sprint("city:", id), options), func() ([]byte, string, error) {
+			city, err := dbInterface.DbGetCity(id, options, db)
+			if err != nil {
+				return nil, "", err
+			}
+			outBuff := []byte(format.CityText(city))
+			return outBuff, representationEtag(city.Version, outBuff), nil
+		})
 	}
 }
 
-func AddCityInfo(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+func AddCityInfo(db *sql.DB, c *cache.Cache, s *suggest.Index) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		body, err := io.ReadAll(r.Body)
-		defer r.Body.Close()
-		if err != nil {
-			outError(w, http.StatusBadRequest, err)
+		newCity := new(structs.CityInfo)
+		if !decodeBody(w, r, newCity) {
 			return
 		}
-		newCity := new(structs.CityInfo)
-		err = json.Unmarshal(body, newCity)
-		if err != nil {
-			outError(w, http.StatusBadRequest, err)
+		if violations := validate.City(newCity); len(violations) > 0 {
+			outViolations(w, violations)
 			return
 		}
-		err = dbInterface.DbAddCity(newCity, db)
+		_, err := cityOperation(r, &structs.BatchOperation{Op: "create", City: newCity}, db)
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
+		c.Purge()
+		s.Add(*newCity, nil)
 		w.WriteHeader(http.StatusCreated)
 		w.Write([]byte(fmt.Sprintf("City %s added\n", newCity.Name)))
 
 	}
 }
 
-func DeleteCity(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+func DeleteCity(db *sql.DB, c *cache.Cache, s *suggest.Index) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id, err := getId(r)
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		err = dbInterface.DbDeleteCity(id, db)
+		before, err := dbInterface.DbGetCity(id, nil, db)
 		if err != nil {
-			outError(w, http.StatusBadRequest, err)
+			outError(w, http.StatusNotFound, err)
+			return
+		}
+		version, ok := ifMatchVersion(w, r, before.Version)
+		if !ok {
 			return
 		}
+		_, err = cityOperation(r, &structs.BatchOperation{Op: "delete", Id: id, Version: version}, db)
+		if err != nil {
+			outWriteError(w, err)
+			return
+		}
+		c.Purge()
+		s.Remove(id)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(fmt.Sprintf("Deleted city with ID %d", id)))
 	}
 }
 
-func UpdatePopulation(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+func UpdatePopulation(db *sql.DB, c *cache.Cache, s *suggest.Index) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id, err := getId(r)
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		body, err := io.ReadAll(r.Body)
-		defer r.Body.Close()
+		population := new(structs.NewPopulation)
+		if !decodeBody(w, r, population) {
+			return
+		}
+		if violations := validate.Population(population); len(violations) > 0 {
+			outViolations(w, violations)
+			return
+		}
+		before, err := dbInterface.DbGetCity(id, nil, db)
+		if err != nil {
+			outError(w, http.StatusNotFound, err)
+			return
+		}
+		version, ok := ifMatchVersion(w, r, before.Version)
+		if !ok {
+			return
+		}
+		entry, err := cityOperation(r, &structs.BatchOperation{Op: "update", Id: id, Population: population,
+			Effective: effectiveDate(population), Version: version}, db)
+		if err != nil {
+			outWriteError(w, err)
+			return
+		}
+		c.Purge()
+		w.Header().Set("ETag", versionEtag(entry.After.Version))
+		indexCity(s, id, db)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintln(w, "New population set")
+	}
+}
+
+func PopulationHistory(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getId(r)
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		population := new(structs.NewPopulation)
-		err = json.Unmarshal(body, population)
+		options, status, err := getReadOptions(r)
+		if err != nil {
+			outError(w, status, err)
+			return
+		}
+		outCached(w, r, c, cacheKey(fmt.Sprint("history:", id), options), func() ([]byte, error) {
+			return dbInterface.DbPopulationHistory(id, options, db)
+		})
+	}
+}
+
+func PopulationGrowth(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getId(r)
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		err = dbInterface.DbPopulationUpdate(id, population, db)
+		from, err := validate.ParseDate(r.URL.Query().Get("from"))
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		w.WriteHeader(http.StatusCreated)
-		fmt.Fprintln(w, "New population set")
+		to, err := validate.ParseDate(r.URL.Query().Get("to"))
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		if to.Before(from) {
+			outError(w, http.StatusBadRequest, errors.New("from must not be later than to"))
+			return
+		}
+		options, status, err := getReadOptions(r)
+		if err != nil {
+			outError(w, status, err)
+			return
+		}
+		key := fmt.Sprintf("growth:%d:%s:%s", id, from.Format("2006-01-02"), to.Format("2006-01-02"))
+		outCached(w, r, c, cacheKey(key, options), func() ([]byte, error) {
+			return dbInterface.DbPopulationGrowth(id, from, to, options, db)
+		})
 	}
 }
 
-func ListByDistrict(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+func RestoreCity(db *sql.DB, c *cache.Cache, s *suggest.Index) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		body, err := io.ReadAll(r.Body)
-		defer r.Body.Close()
+		id, err := getId(r)
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
+		_, err = cityOperation(r, &structs.BatchOperation{Op: "restore", Id: id}, db)
+		if err != nil {
+			outWriteError(w, err)
+			return
+		}
+		c.Purge()
+		indexCity(s, id, db)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("Restored city with ID %d", id)))
+	}
+}
+
+func ListByDistrict(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
 		district := new(structs.StringQuery)
-		err = json.Unmarshal(body, district)
+		if !decodeBody(w, r, district) {
+			return
+		}
+		options, status, err := getReadOptions(r)
 		if err != nil {
-			outError(w, http.StatusBadRequest, err)
+			outError(w, status, err)
+			return
+		}
+		outCityList(w, r, c, "district:" + district.Request, options, func() ([]byte, error) {
+			return dbInterface.DbListByDistrict(district, options, db)
+		})
+	}
+
+}
+
+func ListByRegion(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		region := new(structs.StringQuery)
+		if !decodeBody(w, r, region) {
+			return
+		}
+		options, status, err := getReadOptions(r)
+		if err != nil {
+			outError(w, status, err)
+			return
+		}
+		outCityList(w, r, c, "region:" + region.Request, options, func() ([]byte, error) {
+			return dbInterface.DbListByRegion(region, options, db)
+		})
+	}
+}
+
+func SearchCities(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		if query == "" {
+			outError(w, http.StatusBadRequest, errors.New("search query q is required"))
 			return
 		}
-		outBuff, err := dbInterface.DbListByDistrict(district, db)
+		limit, err := getLimit(r, DEFAULTSEARCHLIMIT, MAXSEARCHLIMIT)
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(outBuff)
+		options, status, err := getReadOptions(r)
+		if err != nil {
+			outError(w, status, err)
+			return
+		}
+		outCityList(w, r, c, fmt.Sprintf("search:%d:%s", limit, strings.ToLower(query)), options, func() ([]byte, error) {
+			return dbInterface.DbSearchCities(query, limit, options, db)
+		})
 	}
+}
 
+// часть ключа кэша для диапазона значений
+func rangeKey(values *structs.Values) string {
+	if values.Unknown {
+		return "unknown"
+	}
+	key := ""
+	if values.MinValue != nil {
+		key += strconv.Itoa(*values.MinValue)
+	}
+	key += "-"
+	if values.MaxValue != nil {
+		key += strconv.Itoa(*values.MaxValue)
+	}
+	return key
 }
 
-func ListByRegion(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+func ListByPopulation(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		body, err := io.ReadAll(r.Body)
-		defer r.Body.Close()
+		populationRange := new(structs.Values)
+		if !decodeBody(w, r, populationRange) {
+			return
+		}
+		if violations := validate.Values(populationRange, true, false); len(violations) > 0 {
+			outViolations(w, violations)
+			return
+		}
+		options, status, err := getReadOptions(r)
+		if err != nil {
+			outError(w, status, err)
+			return
+		}
+		outCityList(w, r, c, "population:"+rangeKey(populationRange), options, func() ([]byte, error) {
+			return dbInterface.DbListByPopulation(populationRange, options, db)
+		})
+	}
+}
+
+func ListByFoundation(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		foundationRange := new(structs.Values)
+		if !decodeBody(w, r, foundationRange) {
+			return
+		}
+		if violations := validate.Values(foundationRange, false, true); len(violations) > 0 {
+			outViolations(w, violations)
+			return
+		}
+		options, status, err := getReadOptions(r)
+		if err != nil {
+			outError(w, status, err)
+			return
+		}
+		outCityList(w, r, c, "foundation:"+rangeKey(foundationRange), options, func() ([]byte, error) {
+			return dbInterface.DbListByFoundation(foundationRange, options, db)
+		})
+	}
+
+}
+
+func CreateApiKey(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keyRequest := new(structs.ApiKeyRequest)
+		if !decodeBody(w, r, keyRequest) {
+			return
+		}
+		if keyRequest.Name == "" {
+			outError(w, http.StatusBadRequest, errors.New("key name must not be empty"))
+			return
+		}
+		role, err := auth.ParseRole(keyRequest.Role)
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		region := new(structs.StringQuery)
-		err = json.Unmarshal(body, region)
+		key, err := auth.CreateKey(keyRequest.Name, role, db)
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		outBuff, err := dbInterface.DbListByRegion(region, db)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintln(w, key)
+	}
+}
+
+func ListApiKeys(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		outBuff, err := dbInterface.DbListApiKeys(db)
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
@@ -167,35 +585,157 @@ func ListByRegion(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func ListByPopulation(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+func DeleteApiKey(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		body, err := io.ReadAll(r.Body)
-		defer r.Body.Close()
+		name := chi.URLParam(r, "key_Name")
+		err := dbInterface.DbDeleteApiKey(name, db)
+		if err != nil {
+			outError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("Deleted API key %s", name)))
+	}
+}
+
+// время в фильтрах запросов: RFC3339 или дата вида 2006-01-02 (начало суток UTC)
+func parseTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", value)
+	}
+	if err != nil {
+		return nil, errors.New("time must be in RFC3339 or YYYY-MM-DD format")
+	}
+	return &t, nil
+}
+
+func ListAudit(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := &structs.AuditFilter{Actor: query.Get("actor")}
+		if query.Get("city") != "" {
+			id, err := strconv.Atoi(query.Get("city"))
+			if err != nil {
+				outError(w, http.StatusBadRequest, errors.New("city must be of int type"))
+				return
+			}
+			filter.CityId = &id
+		}
+		var err error
+		filter.From, err = parseTime(query.Get("from"))
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		populationRange := new(structs.Values)
-		err = json.Unmarshal(body, populationRange)
+		filter.To, err = parseTime(query.Get("to"))
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		if populationRange.MinValue > populationRange.MaxValue && populationRange.MaxValue != 0 {
-			outError(w, http.StatusBadRequest, errors.New("chech the population range data"))
+		filter.Limit, err = getLimit(r, DEFAULTAUDITLIMIT, MAXAUDITLIMIT)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		outBuff, err := dbInterface.DbListByPopulation(populationRange, db)
+		if query.Get("after_id") != "" {
+			filter.AfterId, err = strconv.ParseInt(query.Get("after_id"), 10, 64)
+			if err != nil {
+				outError(w, http.StatusBadRequest, errors.New("after_id must be of int type"))
+				return
+			}
+		}
+		outBuff, next, err := dbInterface.DbListAudit(filter, db)
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
+		if next != 0 {
+			w.Header().Set("X-Next-After-Id", strconv.FormatInt(next, 10)) //следующая страница: ?after_id=next
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write(outBuff)
 	}
 }
 
-func ListByFoundation(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+func validPoint(latitude float64, longitude float64) bool {
+	return latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180
+}
+
+// обработчик геопоиска: разбирает точку, проверяет ее и отдает результат list (с учетом кэша)
+func geoHandler(db *sql.DB, c *cache.Cache, kind string, check func(point *structs.GeoQuery) error,
+	list func(point *structs.GeoQuery, options *structs.ReadOptions, db *sql.DB) ([]byte, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		point := new(structs.GeoQuery)
+		if !decodeBody(w, r, point) {
+			return
+		}
+		if !validPoint(point.Latitude, point.Longitude) {
+			outError(w, http.StatusBadRequest, errors.New("latitude must be within [-90, 90] and longitude within [-180, 180]"))
+			return
+		}
+		err := check(point)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		options, status, err := getReadOptions(r)
+		if err != nil {
+			outError(w, status, err)
+			return
+		}
+		key := fmt.Sprintf("%s:%g:%g:%g:%d", kind, point.Latitude, point.Longitude, point.RadiusKm, point.Count)
+		outCityList(w, r, c, key, options, func() ([]byte, error) {
+			return list(point, options, db)
+		})
+	}
+}
+
+func ListByRadius(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return geoHandler(db, c, "radius", func(point *structs.GeoQuery) error {
+		if point.RadiusKm <= 0 {
+			return errors.New("radius_km must be positive")
+		}
+		return nil
+	}, dbInterface.DbListByRadius)
+}
+
+func ListNearest(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return geoHandler(db, c, "nearest", func(point *structs.GeoQuery) error {
+		if point.Count < 1 || point.Count > 1000 {
+			return errors.New("count must be within [1, 1000]")
+		}
+		return nil
+	}, dbInterface.DbListNearest)
+}
+
+func ListByBoundingBox(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		box := new(structs.BoundingBox)
+		if !decodeBody(w, r, box) {
+			return
+		}
+		if !validPoint(box.MinLatitude, box.MinLongitude) || !validPoint(box.MaxLatitude, box.MaxLongitude) || box.MinLatitude > box.MaxLatitude {
+			outError(w, http.StatusBadRequest, errors.New("chech the bounding box data"))
+			return
+		}
+		options, status, err := getReadOptions(r)
+		if err != nil {
+			outError(w, status, err)
+			return
+		}
+		key := fmt.Sprintf("bbox:%g:%g:%g:%g", box.MinLatitude, box.MinLongitude, box.MaxLatitude, box.MaxLongitude)
+		outCityList(w, r, c, key, options, func() ([]byte, error) {
+			return dbInterface.DbListByBoundingBox(box, options, db)
+		})
+	}
+}
+
+// импорт списка городов: CSV (формат cities.csv) или GeoJSON при Content-Type application/geo+json
+func ImportCities(db *sql.DB, c *cache.Cache, s *suggest.Index) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := io.ReadAll(r.Body)
 		defer r.Body.Close()
@@ -203,23 +743,35 @@ func ListByFoundation(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		foundationRange := new(structs.Values)
-		err = json.Unmarshal(body, foundationRange)
+		var cities []structs.CityInfo
+		if strings.HasPrefix(r.Header.Get("Content-Type"), format.GeoJSONContentType) {
+			cities, err = format.ParseGeoJson(body)
+		} else {
+			cities, err = format.ParseCsv(strings.NewReader(string(body)))
+		}
 		if err != nil {
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		if foundationRange.MinValue > foundationRange.MaxValue && foundationRange.MaxValue != 0 {
-			outError(w, http.StatusBadRequest, errors.New("chech the foundation range data"))
+		var violations validate.Violations
+		for i := range cities {
+			for _, violation := range validate.City(&cities[i]) {
+				violation.Field = fmt.Sprintf("[%d].%s", i, violation.Field)
+				violations = append(violations, violation)
+			}
+		}
+		if len(violations) > 0 {
+			outViolations(w, violations)
 			return
 		}
-		outBuff, err := dbInterface.DbListByFoundation(foundationRange, db)
-		if err != nil {
+		err = dbInterface.DbImportCities(cities, auth.Actor(r), middleware.GetReqID(r.Context()), db)
+		if err != nil { //импорт откатывается целиком, данные не изменились
 			outError(w, http.StatusBadRequest, err)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(outBuff)
+		c.Purge()
+		reloadIndex(s, db)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(fmt.Sprintf("%d cities imported", len(cities))))
 	}
-
 }
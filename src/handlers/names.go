@@ -0,0 +1,88 @@
+//Обработчики других названий города
+
+package handlers
+
+import (
+	"cities/src/cache"
+	"cities/src/dbInterface"
+	"cities/src/structs"
+	"cities/src/suggest"
+	"cities/src/validate"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func ListCityNames(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getId(r)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		options, status, err := getReadOptions(r)
+		if err != nil {
+			outError(w, status, err)
+			return
+		}
+		outCached(w, r, c, cacheKey(fmt.Sprint("names:", id), options), func() ([]byte, error) {
+			return dbInterface.DbListCityNames(id, options, db)
+		})
+	}
+}
+
+func AddCityName(db *sql.DB, c *cache.Cache, s *suggest.Index) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getId(r)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		name := new(structs.CityName)
+		if !decodeBody(w, r, name) {
+			return
+		}
+		name.CityId = id
+		if violations := validate.CityName(name); len(violations) > 0 {
+			outViolations(w, violations)
+			return
+		}
+		err = dbInterface.DbAddCityName(name, db)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		c.Purge()
+		indexCity(s, id, db)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(fmt.Sprintf("Added name %s with ID %d", name.Name, name.Id)))
+	}
+}
+
+func DeleteCityName(db *sql.DB, c *cache.Cache, s *suggest.Index) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getId(r)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		nameId, err := strconv.Atoi(chi.URLParam(r, "name_Id"))
+		if err != nil {
+			outError(w, http.StatusBadRequest, errors.New("name ID must be of int type"))
+			return
+		}
+		err = dbInterface.DbDeleteCityName(id, nameId, db)
+		if err != nil {
+			outError(w, http.StatusNotFound, err)
+			return
+		}
+		c.Purge()
+		indexCity(s, id, db)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("Deleted name with ID %d", nameId)))
+	}
+}
@@ -0,0 +1,215 @@
+//Обработчики справочников регионов и федеральных округов
+
+package handlers
+
+import (
+	"cities/src/auth"
+	"cities/src/cache"
+	"cities/src/dbInterface"
+	"cities/src/format"
+	"cities/src/structs"
+	"cities/src/suggest"
+	"cities/src/validate"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func getItemId(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "item_Id"))
+	if err != nil {
+		return id, errors.New("ID must be of int type")
+	}
+	return id, nil
+}
+
+// читает и проверяет запись справочника; при ошибке отвечает сам и возвращает nil
+func readDictionaryItem(w http.ResponseWriter, r *http.Request) *structs.DictionaryItem {
+	item := new(structs.DictionaryItem)
+	if !decodeBody(w, r, item) {
+		return nil
+	}
+	if violations := validate.DictionaryItem(item); len(violations) > 0 {
+		outViolations(w, violations)
+		return nil
+	}
+	return item
+}
+
+// kind - region или district
+func ListDictionary(kind string, db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		options := &structs.ReadOptions{Languages: format.Languages(r)}
+		outCached(w, r, c, cacheKey("dictionary:"+kind, options), func() ([]byte, error) {
+			if kind == "district" {
+				return dbInterface.DbListDistricts(options.Languages, db)
+			}
+			return dbInterface.DbListRegions(options.Languages, db)
+		})
+	}
+}
+
+func GetDictionaryItem(kind string, db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getItemId(r)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		item, err := dbInterface.DbGetDictionaryItem(kind, id, format.Languages(r), db)
+		if err != nil {
+			outError(w, http.StatusNotFound, err)
+			return
+		}
+		outBuff, err := json.Marshal(item)
+		if err != nil {
+			outError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Vary", "Accept-Language")
+		w.WriteHeader(http.StatusOK)
+		w.Write(outBuff)
+	}
+}
+
+func AddDictionaryItem(kind string, db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		item := readDictionaryItem(w, r)
+		if item == nil {
+			return
+		}
+		err := dbInterface.DbAddDictionaryItem(kind, item, db)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		c.Purge()
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(fmt.Sprintf("Added %s %s with ID %d", kind, item.Name, item.Id)))
+	}
+}
+
+func UpdateDictionaryItem(kind string, db *sql.DB, c *cache.Cache, s *suggest.Index) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getItemId(r)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		item := readDictionaryItem(w, r)
+		if item == nil {
+			return
+		}
+		item.Id = id
+		err = dbInterface.DbUpdateDictionaryItem(kind, item, auth.Actor(r), middleware.GetReqID(r.Context()), db)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		c.Purge()
+		reloadIndex(s, db)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("Updated %s with ID %d", kind, id)))
+	}
+}
+
+func DeleteDictionaryItem(kind string, db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getItemId(r)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = dbInterface.DbDeleteDictionaryItem(kind, id, db)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		c.Purge()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("Deleted %s with ID %d", kind, id)))
+	}
+}
+
+// перенос текстовых регионов и округов в справочники, в ответе - отчет об объединенных написаниях
+func MigrateRegions(db *sql.DB, c *cache.Cache, s *suggest.Index) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := dbInterface.DbMigrateRegions(auth.Actor(r), middleware.GetReqID(r.Context()), db)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		c.Purge()
+		reloadIndex(s, db)
+		w.WriteHeader(http.StatusOK)
+		w.Write(report)
+	}
+}
+
+func ListDictionaryNames(kind string, db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getItemId(r)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		outCached(w, r, c, fmt.Sprintf("dictionary-names:%s:%d", kind, id), func() ([]byte, error) {
+			return dbInterface.DbListDictionaryNames(kind, id, db)
+		})
+	}
+}
+
+// перевод названия на язык {lang} с json-структурой вида {"name": string}
+func SetDictionaryName(kind string, db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getItemId(r)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		lang := strings.ToLower(chi.URLParam(r, "lang"))
+		name := new(structs.DictionaryName)
+		if !decodeBody(w, r, name) {
+			return
+		}
+		if violations := validate.DictionaryName(lang, name); len(violations) > 0 {
+			outViolations(w, violations)
+			return
+		}
+		err = dbInterface.DbSetDictionaryName(kind, id, lang, name.Name, db)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		c.Purge()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("Set %s name of %s with ID %d", lang, kind, id)))
+	}
+}
+
+func DeleteDictionaryName(kind string, db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getItemId(r)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		lang := strings.ToLower(chi.URLParam(r, "lang"))
+		err = dbInterface.DbDeleteDictionaryName(kind, id, lang, db)
+		if err != nil {
+			outError(w, http.StatusNotFound, err)
+			return
+		}
+		c.Purge()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("Deleted %s name of %s with ID %d", lang, kind, id)))
+	}
+}
@@ -0,0 +1,71 @@
+//Обработчики статистических запросов
+
+package handlers
+
+import (
+	"cities/src/cache"
+	"cities/src/dbInterface"
+	"cities/src/structs"
+	"cities/src/validate"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func GroupStats(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group := chi.URLParam(r, "group")
+		options, status, err := getReadOptions(r)
+		if err != nil {
+			outError(w, status, err)
+			return
+		}
+		outCached(w, r, c, cacheKey("stats:"+group, options), func() ([]byte, error) {
+			return dbInterface.DbGroupStats(group, options, db)
+		})
+	}
+}
+
+func PopulationHistogram(db *sql.DB, c *cache.Cache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		histogram := new(structs.HistogramQuery)
+		if len(body) > 0 {
+			err = validate.Decode(body, histogram)
+			if err != nil {
+				outInputError(w, err)
+				return
+			}
+		}
+		for i := 1; i < len(histogram.Buckets); i++ {
+			if histogram.Buckets[i] <= histogram.Buckets[i-1] {
+				outError(w, http.StatusBadRequest, errors.New("buckets must be in ascending order"))
+				return
+			}
+		}
+		if len(histogram.Buckets) == 0 {
+			histogram.Buckets, err = dbInterface.DefaultHistogramBounds(db)
+			if err != nil {
+				outError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		options, status, err := getReadOptions(r)
+		if err != nil {
+			outError(w, status, err)
+			return
+		}
+		outCached(w, r, c, cacheKey(fmt.Sprint("histogram:", histogram.Buckets), options), func() ([]byte, error) {
+			return dbInterface.DbPopulationHistogram(histogram.Buckets, options, db)
+		})
+	}
+}
@@ -0,0 +1,84 @@
+//Обработчик подсказок по началу названия города
+
+package handlers
+
+import (
+	"cities/src/dbInterface"
+	"cities/src/format"
+	"cities/src/structs"
+	"cities/src/suggest"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// число подсказок по умолчанию и наибольшее
+const (
+	DEFAULTSUGGESTLIMIT = 10
+	MAXSUGGESTLIMIT     = 50
+)
+
+// перечитывает индекс подсказок из базы после изменений, затрагивающих много городов
+func reloadIndex(s *suggest.Index, db *sql.DB) {
+	cities, err := dbInterface.DbLoadCities(db)
+	if err == nil {
+		var names map[int][]string
+		names, err = dbInterface.DbAllCityNames(db)
+		if err == nil {
+			s.Load(cities, names)
+			return
+		}
+	}
+	log.Print("suggest index reload failed: ", err)
+}
+
+// обновляет в индексе подсказок один город; удаленный или недоступный город убирается из индекса
+func indexCity(s *suggest.Index, id int, db *sql.DB) {
+	city, err := dbInterface.DbGetCity(id, nil, db)
+	if err != nil {
+		s.Remove(id)
+		return
+	}
+	names, err := dbInterface.DbCityNames(id, db)
+	if err != nil {
+		log.Printf("names of city %d are not readable: %s", id, err.Error())
+	}
+	s.Add(*city, names)
+}
+
+// подсказки берутся из индекса в памяти, без кэша ответов; к базе обращаются только за переводами названий,
+// если клиент запросил другой язык (?lang= или Accept-Language)
+func Suggest(s *suggest.Index, db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix := strings.TrimSpace(r.URL.Query().Get("q"))
+		if prefix == "" {
+			outError(w, http.StatusBadRequest, errors.New("prefix q is required"))
+			return
+		}
+		limit, err := getLimit(r, DEFAULTSUGGESTLIMIT, MAXSUGGESTLIMIT)
+		if err != nil {
+			outError(w, http.StatusBadRequest, err)
+			return
+		}
+		options := &structs.ReadOptions{Format: format.Negotiate(r), Languages: format.Languages(r)}
+		cities := s.Suggest(prefix, limit)
+		if len(options.Languages) > 0 && len(cities) > 0 {
+			cities, err = dbInterface.DbLocalizeCities(cities, options, db)
+			if err != nil {
+				outError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		body, err := format.CityList(cities, options, "No cities start with "+prefix)
+		if err != nil {
+			outError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", format.ContentType(options.Format))
+		w.Header().Set("Vary", "Accept, Accept-Language")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}
+}
@@ -0,0 +1,90 @@
+//Оптимистичная блокировка изменений города по версии строки (ETag и If-Match)
+
+package handlers
+
+import (
+	"cities/src/cache"
+	"cities/src/dbInterface"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ETag версии строки города; для версий из истории до появления версий (0) ETag вычисляется по телу ответа
+func versionEtag(version int) string {
+	if version <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(`"v%d"`, version)
+}
+
+// ETag ответа GET /cities/xxx вида "v3-<хэш тела>": тело зависит не только от версии строки, но и от языка, формата
+// и других названий города, изменение которых версию не увеличивает. If-Match сравнивает только версию
+func representationEtag(version int, body []byte) string {
+	etag := versionEtag(version)
+	if etag == "" {
+		return ""
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + strings.Trim(cache.Etag(body), `"`)[:16] + `"`
+}
+
+// версия из ETag вида "v3" или "v3-<хэш тела>"
+func etagVersion(etag string) (int, bool) {
+	if !strings.HasPrefix(etag, `"v`) || !strings.HasSuffix(etag, `"`) || len(etag) < 4 {
+		return 0, false
+	}
+	value := etag[2 : len(etag)-1]
+	if dash := strings.IndexByte(value, '-'); dash >= 0 {
+		value = value[:dash]
+	}
+	version, err := strconv.Atoi(value)
+	return version, err == nil && version > 0
+}
+
+// сверяет If-Match с текущей версией города. Возвращает версию, которую база должна проверить при изменении
+// (nil - If-Match не задан или равен "*"); при несовпадении отвечает 412 и возвращает ok=false
+func ifMatchVersion(w http.ResponseWriter, r *http.Request, current int) (version *int, ok bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return nil, true
+	}
+	etag := versionEtag(current)
+	for _, match := range strings.Split(header, ",") {
+		//слабые ETag (W/"...") в If-Match не совпадают по определению; ETag любого представления
+		//текущей версии (на любом языке и в любом формате) совпадает
+		if version, ok := etagVersion(strings.TrimSpace(match)); ok && current > 0 && version == current {
+			return &current, true
+		}
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag) //текущая версия, чтобы клиент мог перечитать город и повторить
+	}
+	outError(w, http.StatusPreconditionFailed, dbInterface.ErrVersionMismatch)
+	return nil, false
+}
+
+// ошибка чтения или изменения города: 404 - города нет, 412 - версия изменилась после проверки If-Match
+func outWriteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, dbInterface.ErrNoCity), errors.Is(err, dbInterface.ErrNoDeletedCity):
+		outError(w, http.StatusNotFound, err)
+	case errors.Is(err, dbInterface.ErrVersionMismatch):
+		outError(w, http.StatusPreconditionFailed, err)
+	default:
+		outError(w, http.StatusBadRequest, err)
+	}
+}
+
+// при RequireIfMatch (settings.ini) изменение и удаление города без If-Match отклоняются с 428,
+// чтобы клиент не мог перезаписать чужое изменение, не прочитав город
+func RequireIfMatch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Match") == "" {
+			outError(w, http.StatusPreconditionRequired, errors.New("If-Match header with the city ETag is required"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,212 @@
+//Модуль ключей идемпотентности изменяющих запросов
+
+//Клиенты за прокси повторяют запросы по таймауту, и без защиты повтор добавляет или изменяет город второй раз.
+//Запрос POST, PUT, PATCH или DELETE с заголовком Idempotency-Key выполняется один раз: ключ вместе с ответом
+//хранится в таблице idempotencyKeys (общей для всех узлов) в течение окна window, а повтор с тем же ключом получает
+//сохраненный ответ (статус, тело, Content-Type и ETag) с заголовком Idempotent-Replayed: true. Ключ действует
+//в пределах клиента (auth.Actor). Повтор ключа с другим методом, адресом или телом отклоняется с 422, повтор
+//до завершения первого запроса - 409. Ответы 5xx и запросы, завершившиеся паникой, не сохраняются, чтобы запрос
+//можно было повторить после временной ошибки. Ключ, первый запрос с которым не завершился за inFlight (узел
+//остановился во время запроса), снова может быть занят
+
+package idempotency
+
+import (
+	"bytes"
+	"cities/src/auth"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	Header         = "Idempotency-Key"
+	ReplayedHeader = "Idempotent-Replayed"
+	maxKeyLength   = 255 //размер столбца key
+)
+
+const cleanupInterval = 10 * time.Minute
+
+type Store struct {
+	db          *sql.DB
+	window      time.Duration
+	inFlight    time.Duration
+	mu          sync.Mutex
+	lastCleanup time.Time
+}
+
+// При window <= 0 ключи идемпотентности не обрабатываются; inFlight - наибольшее время выполнения первого запроса
+func New(db *sql.DB, window time.Duration, inFlight time.Duration) *Store {
+	return &Store{db: db, window: window, inFlight: inFlight, lastCleanup: time.Now()}
+}
+
+// запоминает статус и тело ответа, одновременно передавая их клиенту
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
+
+func mutating(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch || method == http.MethodDelete
+}
+
+// отпечаток запроса: метод, адрес и тело
+func requestHash(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// удаляет устаревшие ключи не чаще раза в cleanupInterval
+func (s *Store) cleanup() {
+	s.mu.Lock()
+	if time.Since(s.lastCleanup) < cleanupInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastCleanup = time.Now()
+	s.mu.Unlock()
+	_, err := s.db.Exec("DELETE FROM idempotencyKeys WHERE created < now() - $1 * interval '1 second'", s.window.Seconds())
+	if err != nil {
+		log.Print("cleanup of idempotency keys failed: ", err)
+	}
+}
+
+// занимает ключ: новая запись или замена устаревшей либо зависшей (первый запрос не завершился за inFlight).
+// false - ключ уже занят действующей записью
+func (s *Store) claim(actor string, key string, hash string) (bool, error) {
+	result, err := s.db.Exec(`INSERT INTO idempotencyKeys (actor, key, requestHash) VALUES ($1, $2, $3)
+		ON CONFLICT (actor, key) DO UPDATE SET requestHash=excluded.requestHash, status=NULL, contentType='', etag='', body=NULL, created=now()
+		WHERE idempotencyKeys.created < now() - $4 * interval '1 second'
+			OR (idempotencyKeys.status IS NULL AND idempotencyKeys.created < now() - $5 * interval '1 second')`,
+		actor, key, hash, s.window.Seconds(), s.inFlight.Seconds())
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (s *Store) Handler(next http.Handler) http.Handler {
+	if s.window <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" || !mutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Idempotency-Key must not be longer than 255 characters"))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		s.cleanup()
+		actor, hash := auth.Actor(r), requestHash(r, body)
+		claimed, err := s.claim(actor, key, hash)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("idempotency key is not available: " + err.Error()))
+			return
+		}
+		if !claimed {
+			s.replay(w, actor, key, hash)
+			return
+		}
+		defer func() { //паника обработчика освобождает ключ, иначе повторы получали бы 409 до истечения inFlight
+			if p := recover(); p != nil {
+				s.release(actor, key)
+				panic(p)
+			}
+		}()
+		rec := &recorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= http.StatusInternalServerError {
+			s.release(actor, key)
+			return
+		}
+		_, err = s.db.Exec("UPDATE idempotencyKeys SET status=$3, contentType=$4, etag=$5, body=$6 WHERE actor=$1 AND key=$2",
+			actor, key, rec.status, w.Header().Get("Content-Type"), w.Header().Get("ETag"), rec.body.Bytes())
+		if err != nil {
+			log.Printf("idempotency key %q of %s is not saved: %s", key, actor, err.Error())
+		}
+	})
+}
+
+// освобождает ключ запроса, ответ на который не сохраняется
+func (s *Store) release(actor string, key string) {
+	_, err := s.db.Exec("DELETE FROM idempotencyKeys WHERE actor=$1 AND key=$2", actor, key)
+	if err != nil {
+		log.Printf("idempotency key %q of %s is not released: %s", key, actor, err.Error())
+	}
+}
+
+// отдает сохраненный ответ на повтор запроса с занятым ключом
+func (s *Store) replay(w http.ResponseWriter, actor string, key string, hash string) {
+	var storedHash, contentType, etag string
+	var status sql.NullInt64
+	var body []byte
+	err := s.db.QueryRow("SELECT requestHash, status, contentType, etag, body FROM idempotencyKeys WHERE actor=$1 AND key=$2",
+		actor, key).Scan(&storedHash, &status, &contentType, &etag, &body)
+	if err != nil {
+		//запись могли удалить между claim и чтением (ответ 5xx или очистка), клиент может повторить запрос
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("request with this Idempotency-Key is being processed, try again later"))
+		return
+	}
+	if storedHash != hash {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("Idempotency-Key was already used with a different request"))
+		return
+	}
+	if !status.Valid {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("request with this Idempotency-Key is being processed, try again later"))
+		return
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(int(status.Int64))
+	w.Write(body)
+}
@@ -0,0 +1,192 @@
+//Модуль ограничения частоты запросов
+
+//Ограничение по алгоритму token bucket: у каждого клиента своя корзина на burst запросов,
+//пополняемая со скоростью rate запросов в секунду. Handler ограничивает запросы по IP-адресу и ставится до
+//аутентификации, KeyHandler - по имени клиента, проверенному аутентификацией, и ставится после нее: запрос
+//с действующим ключом проходит обе корзины. Сырой заголовок X-API-Key ключом корзины не служит, иначе клиент,
+//меняющий ключ в каждом запросе, получал бы каждый раз новую полную корзину.
+//Адрес клиента за прокси берется из X-Forwarded-For, но только из записей, добавленных доверенными прокси:
+//заголовок читается справа налево, пока адреса принадлежат доверенным сетям. Иначе клиент, подставляющий
+//в каждом запросе новый X-Forwarded-For, получал бы новую корзину.
+//При исчерпании корзины возвращается 429 Too Many Requests с заголовком Retry-After
+
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cleanupInterval = 10 * time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type Limiter struct {
+	mu          sync.Mutex
+	rate        float64
+	burst       float64
+	trusted     []*net.IPNet
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+}
+
+// При rate <= 0 ограничение не действует; trusted - сети доверенных прокси, которым разрешено передавать
+// адрес клиента в X-Forwarded-For
+func New(rate float64, burst int, trusted []*net.IPNet) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:        rate,
+		burst:       float64(burst),
+		trusted:     trusted,
+		buckets:     make(map[string]*bucket),
+		lastCleanup: time.Now(),
+	}
+}
+
+// сети из списка адресов ("10.0.0.5") и подсетей ("10.0.0.0/8")
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("wrong network address " + item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func contains(networks []*net.IPNet, host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// true - запрос пришел от доверенного прокси и его X-Forwarded-For можно передать дальше
+func TrustedPeer(r *http.Request, trusted []*net.IPNet) bool {
+	return contains(trusted, remoteHost(r))
+}
+
+// адрес клиента: X-Forwarded-For читается справа налево, пока запрос передавали доверенные прокси,
+// первый адрес вне доверенных сетей - клиент. От недоверенного отправителя заголовок не учитывается
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host := remoteHost(r)
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0 && contains(trusted, host); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break //испорченная запись: дальше нее адресам верить нельзя
+		}
+		host = hop
+	}
+	return host
+}
+
+// забирает токен из корзины клиента, при отказе возвращает время до появления следующего токена
+func (l *Limiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastCleanup) > cleanupInterval {
+		//полные корзины ничем не отличаются от новых, их можно удалить
+		for k, b := range l.buckets {
+			if now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastCleanup = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// ограничение по IP-адресу клиента
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return l.limit(func(r *http.Request) string { return "ip:" + clientIP(r, l.trusted) }, next)
+}
+
+// ограничение по имени клиента, которое возвращает client (например auth.Actor); запросы с пустым именем
+// не ограничиваются - их уже ограничил Handler
+func (l *Limiter) KeyHandler(client func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return l.limit(func(r *http.Request) string {
+			if name := client(r); name != "" {
+				return "key:" + name
+			}
+			return ""
+		}, next)
+	}
+}
+
+func (l *Limiter) limit(key func(r *http.Request) string, next http.Handler) http.Handler {
+	if l.rate <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucketKey := key(r)
+		if bucketKey == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := l.allow(bucketKey)
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("too many requests, try again later"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
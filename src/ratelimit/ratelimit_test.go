@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	//узел: доверяет своему прокси на локальном адресе и внешнему прокси 10.0.0.5
+	trusted, err := ParseNetworks([]string{"127.0.0.0/8", "::1", "10.0.0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"direct client", "203.0.113.7:5000", "", "203.0.113.7"},
+		{"direct client with forged header", "203.0.113.7:5000", "198.51.100.1", "203.0.113.7"},
+		{"client of the local proxy", "127.0.0.1:40000", "203.0.113.7", "203.0.113.7"},
+		{"local caller of the local proxy", "127.0.0.1:40000", "127.0.0.1", "127.0.0.1"},
+		{"client of the front proxy", "127.0.0.1:40000", "203.0.113.7, 10.0.0.5", "203.0.113.7"},
+		{"forged entry left of the front proxy", "127.0.0.1:40000", "198.51.100.1, 203.0.113.7, 10.0.0.5", "203.0.113.7"},
+		{"untrusted hop stops the walk", "127.0.0.1:40000", "198.51.100.1, 192.0.2.9", "192.0.2.9"},
+		{"malformed entry", "127.0.0.1:40000", "203.0.113.7, junk", "127.0.0.1"},
+		{"IPv6 loopback proxy", "[::1]:40000", "2001:db8::1", "2001:db8::1"},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if got := clientIP(r, trusted); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestClientIPWithoutTrustedProxies(t *testing.T) {
+	//прокси без -trustedproxies: заголовок локального клиента тоже не учитывается
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "127.0.0.1:40000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := clientIP(r, nil); got != "127.0.0.1" {
+		t.Errorf("got %s, want 127.0.0.1", got)
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"10.0.0.0/8", " 192.0.2.1 ", "", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 3 {
+		t.Fatalf("got %d networks, want 3", len(networks))
+	}
+	for _, host := range []string{"10.1.2.3", "192.0.2.1", "2001:db8::1"} {
+		if !contains(networks, host) {
+			t.Errorf("%s is not in the networks", host)
+		}
+	}
+	if contains(networks, "192.0.2.2") {
+		t.Error("192.0.2.2 must not be in the networks")
+	}
+	if _, err = ParseNetworks([]string{"not-an-address"}); err == nil {
+		t.Error("wrong address accepted")
+	}
+}
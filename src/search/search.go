@@ -0,0 +1,149 @@
+//Модуль нечеткого поиска городов по названию
+
+//Запрос и названия сравниваются во всех формах translit.Keys, поэтому "Nizhny Novgorod", "нижний новгород"
+//и "Nižnij Novgorod" находят один город. Оценка сходства от 0 до 1: полное совпадение - 1, совпадение начала
+//названия - от 0.9, иначе наибольшее из сходства по триграммам и по расстоянию Левенштейна
+
+package search
+
+import (
+	"cities/src/structs"
+	"cities/src/translit"
+	"sort"
+	"strings"
+)
+
+// результаты с меньшей оценкой отбрасываются
+const MinScore = 0.45
+
+func trigrams(s string) map[string]bool {
+	padded := []rune("  " + s + " ")
+	set := make(map[string]bool)
+	for i := 0; i+3 <= len(padded); i++ {
+		set[string(padded[i:i+3])] = true
+	}
+	return set
+}
+
+// сходство по триграммам как в pg_trgm: доля общих триграмм
+func Trigram(a string, b string) float64 {
+	setA, setB := trigrams(a), trigrams(b)
+	common := 0
+	for gram := range setA {
+		if setB[gram] {
+			common++
+		}
+	}
+	union := len(setA) + len(setB) - common
+	if union == 0 {
+		return 0
+	}
+	return float64(common) / float64(union)
+}
+
+func Levenshtein(a string, b string) int {
+	runesA, runesB := []rune(a), []rune(b)
+	previous := make([]int, len(runesB)+1)
+	current := make([]int, len(runesB)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(runesA); i++ {
+		current[0] = i
+		for j := 1; j <= len(runesB); j++ {
+			cost := 1
+			if runesA[i-1] == runesB[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(runesB)]
+}
+
+func min(values ...int) int {
+	result := values[0]
+	for _, value := range values[1:] {
+		if value < result {
+			result = value
+		}
+	}
+	return result
+}
+
+func similarity(query string, name string) float64 {
+	if query == name {
+		return 1
+	}
+	queryLen, nameLen := len([]rune(query)), len([]rune(name))
+	if strings.HasPrefix(name, query) {
+		return 0.9 + 0.1*float64(queryLen)/float64(nameLen)
+	}
+	longest := queryLen
+	if nameLen > longest {
+		longest = nameLen
+	}
+	score := 1 - float64(Levenshtein(query, name))/float64(longest)
+	if trigram := Trigram(query, name); trigram > score {
+		score = trigram
+	}
+	//опечатка в начале названия при вводе неполного названия
+	if queryLen < nameLen {
+		prefix := string([]rune(name)[:queryLen])
+		if prefixScore := 0.8 * (1 - float64(Levenshtein(query, prefix))/float64(queryLen)); prefixScore > score {
+			score = prefixScore
+		}
+	}
+	return score
+}
+
+// наибольшее сходство запроса с названием по всем формам записи
+func Score(query string, name string) float64 {
+	best := 0.0
+	for _, queryKey := range translit.Keys(query) {
+		for _, nameKey := range translit.Keys(name) {
+			if score := similarity(queryKey, nameKey); score > best {
+				best = score
+			}
+		}
+	}
+	return best
+}
+
+// порядок по убыванию численности, города с неизвестной численностью - последними
+func MorePopulous(a *structs.CityInfo, b *structs.CityInfo) bool {
+	if a.Population == nil || b.Population == nil {
+		return a.Population != nil && b.Population == nil
+	}
+	return *a.Population > *b.Population
+}
+
+// города, похожие на запрос, по убыванию оценки, при равной оценке - по убыванию численности.
+// names - другие названия городов по cityID; если лучше всего совпало другое название, оно выводится в MatchedBy
+func Rank(query string, cities []structs.CityInfo, names map[int][]string, limit int) []structs.CityInfo {
+	var found []structs.CityInfo
+	for _, city := range cities {
+		score := Score(query, city.Name)
+		for _, name := range names[city.Id] {
+			if nameScore := Score(query, name); nameScore > score {
+				score = nameScore
+				city.MatchedBy = name
+			}
+		}
+		if score >= MinScore {
+			city.Score = &score
+			found = append(found, city)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		if *found[i].Score != *found[j].Score {
+			return *found[i].Score > *found[j].Score
+		}
+		return MorePopulous(&found[i], &found[j])
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
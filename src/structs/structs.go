@@ -2,24 +2,146 @@
 
 package structs
 
+import "time"
+
 type CityInfo struct {
-	Id         int    `json:"id"`
-	Name       string `json:"name"`
-	Region     string `json:"region"`
-	District   string `json:"district"`
-	Population int    `json:"population"`
-	Foundation int    `json:"foundation"`
+	Id         int      `json:"id"`
+	Name       string   `json:"name"`
+	Region     string   `json:"region"`
+	District   string   `json:"district"`
+	Population *int     `json:"population"`            //nil - неизвестна
+	Foundation *int     `json:"foundation"`            //год основания, до нашей эры - отрицательный (-1 - 1 год до н.э.), nil - неизвестен
+	Latitude   *float64 `json:"latitude,omitempty"`    //градусы, nil - координаты неизвестны
+	Longitude  *float64 `json:"longitude,omitempty"`   //градусы
+	Elevation  *float64 `json:"elevation,omitempty"`   //высота над уровнем моря, м
+	Area       *float64 `json:"area_km2,omitempty"`    //площадь, км²
+	Age        *int     `json:"age,omitempty"`         //возраст города в годах, вычисляется при чтении
+	Density    *float64 `json:"density,omitempty"`     //плотность населения, чел./км², вычисляется при чтении
+	Distance   *float64 `json:"distance_km,omitempty"` //расстояние до точки запроса, только в ответах геопоиска
+	Score      *float64 `json:"score,omitempty"`       //сходство с запросом, только в ответах поиска по названию
+	MatchedBy  string   `json:"matched_by,omitempty"`  //другое название, совпавшее с запросом поиска
+	Version    int      `json:"version,omitempty"`     //версия строки, увеличивается при каждом изменении города
+}
+
+// другое название города; ValidFrom и ValidTo - годы действия, nil - граница неизвестна или название действует сейчас
+type CityName struct {
+	Id        int    `json:"id"`
+	CityId    int    `json:"city_id"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang,omitempty"` //код языка, по умолчанию ru
+	Kind      string `json:"kind"`           //official, historical или colloquial
+	ValidFrom *int   `json:"valid_from,omitempty"`
+	ValidTo   *int   `json:"valid_to,omitempty"`
 }
 
 type NewPopulation struct {
-	Value int `json:"value"`
+	Value  int    `json:"value"`
+	Date   string `json:"date,omitempty"`   //дата, на которую действительна численность: YYYY-MM-DD или год переписи YYYY, по умолчанию текущая
+	Source string `json:"source,omitempty"` //источник данных, например "перепись 2021"
 }
 
 type StringQuery struct {
 	Request string `json:"request"`
 }
 
+// диапазон значений, nil - граница не задана; Unknown - выбрать города, у которых значение неизвестно
 type Values struct {
-	MinValue int `json:"min_value,omitempty"`
-	MaxValue int `json:"max_value,omitempty"`
+	MinValue *int `json:"min_value,omitempty"`
+	MaxValue *int `json:"max_value,omitempty"`
+	Unknown  bool `json:"unknown,omitempty"`
+}
+
+// точка поиска: для поиска в радиусе задается RadiusKm, для поиска ближайших городов - Count
+type GeoQuery struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	RadiusKm  float64 `json:"radius_km,omitempty"`
+	Count     int     `json:"count,omitempty"`
+}
+
+// прямоугольник координат; при MinLongitude > MaxLongitude прямоугольник пересекает 180-й меридиан
+type BoundingBox struct {
+	MinLatitude  float64 `json:"min_latitude"`
+	MinLongitude float64 `json:"min_longitude"`
+	MaxLatitude  float64 `json:"max_latitude"`
+	MaxLongitude float64 `json:"max_longitude"`
+}
+
+// границы интервалов гистограммы численности по возрастанию, пустой список - логарифмическая шкала
+type HistogramQuery struct {
+	Buckets []int `json:"buckets,omitempty"`
+}
+
+// запись справочника регионов или федеральных округов; DistrictId - округ региона
+type DictionaryItem struct {
+	Id         int    `json:"id"`
+	Code       string `json:"code,omitempty"`
+	Name       string `json:"name"`
+	DistrictId *int   `json:"district_id,omitempty"`
+}
+
+// перевод названия записи справочника
+type DictionaryName struct {
+	Name string `json:"name"`
+}
+
+type ApiKeyRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// параметры чтения, не входящие в тело запроса
+type ReadOptions struct {
+	IncludeDeleted bool          //показывать помеченные удаленными города (только для администраторов)
+	AsOf           *time.Time    //состояние данных на указанный момент, nil - текущее
+	Format         string        //формат списков: text или geojson
+	Languages      []string      //языки названий в порядке предпочтения, пустой список - русские названия
+	Filters        []RangeFilter //ограничения возраста, плотности и площади
+	Sort           string        //поле сортировки списка, пустая строка - порядок запроса
+	Descending     bool          //сортировка по убыванию
+}
+
+// ограничение вычисляемого или необязательного поля (age, density, area), nil - граница не задана
+type RangeFilter struct {
+	Field string
+	Min   *float64
+	Max   *float64
+}
+
+// запись журнала изменений; Before и After - состояние города до и после изменения
+type AuditEntry struct {
+	Id        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	RequestId string    `json:"request_id"`
+	Action    string    `json:"action"`
+	CityId    int       `json:"city_id"`
+	Before    *CityInfo `json:"before,omitempty"`
+	After     *CityInfo `json:"after,omitempty"`
+}
+
+// отбор записей журнала, пустые поля не ограничивают выборку; записи выдаются страницами по Limit
+type AuditFilter struct {
+	CityId  *int
+	Actor   string
+	From    *time.Time
+	To      *time.Time
+	AfterId int64 //страница начинается с записи, следующей за AfterId
+	Limit   int   //размер страницы
+}
+
+// операция изменения города, в пакете или отдельным запросом: create - добавление города City, update - новая
+// численность Population города Id, delete - удаление города Id. Обработчики используют также import и restore
+type BatchOperation struct {
+	Op         string         `json:"op"`
+	Id         int            `json:"id,omitempty"`
+	City       *CityInfo      `json:"city,omitempty"`
+	Population *NewPopulation `json:"population,omitempty"`
+	Version    *int           `json:"version,omitempty"` //ожидаемая версия города для update и delete, как в If-Match
+	Effective  time.Time      `json:"-"`                 //дата численности для update, определяется обработчиком по Population.Date
+}
+
+type BatchRequest struct {
+	Mode       string           `json:"mode,omitempty"` //atomic (по умолчанию) - всё или ничего, per_item - результат по каждой операции
+	Operations []BatchOperation `json:"operations"`
 }
@@ -0,0 +1,164 @@
+//Модуль подсказок по началу названия города
+
+//Префиксное дерево названий хранится в памяти узла. Каждый город попадает в дерево под текущим и другими
+//названиями во всех формах записи translit.Keys, а также начиная с каждого слова названия
+//("новг" находит Нижний и Великий Новгород, "ленинг" - Санкт-Петербург).
+//Индекс загружается из базы при запуске, обновляется обработчиками изменений и периодически перечитывается,
+//чтобы учесть изменения, сделанные через другие узлы
+
+package suggest
+
+import (
+	"cities/src/search"
+	"cities/src/structs"
+	"cities/src/translit"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type node struct {
+	children map[rune]*node
+	ids      map[int]struct{} //города, одна из форм названия которых заканчивается в этом узле
+}
+
+type Index struct {
+	mu     sync.RWMutex
+	root   *node
+	cities map[int]structs.CityInfo
+	keys   map[int][]string //ключи, под которыми город записан в дерево
+}
+
+func newNode() *node {
+	return &node{children: make(map[rune]*node), ids: make(map[int]struct{})}
+}
+
+func New() *Index {
+	return &Index{root: newNode(), cities: make(map[int]structs.CityInfo), keys: make(map[int][]string)}
+}
+
+// все ключи названий: каждая форма записи целиком и с начала каждого следующего слова
+func nameKeys(names []string) []string {
+	var keys []string
+	for _, name := range names {
+		for _, key := range translit.Keys(name) {
+			words := strings.Fields(key)
+			for i := range words {
+				keys = append(keys, strings.Join(words[i:], " "))
+			}
+		}
+	}
+	return keys
+}
+
+// заменяет содержимое индекса списком городов; names - другие названия городов по cityID
+func (s *Index) Load(cities []structs.CityInfo, names map[int][]string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.root = newNode()
+	s.cities = make(map[int]structs.CityInfo)
+	s.keys = make(map[int][]string)
+	for _, city := range cities {
+		s.add(city, names[city.Id])
+	}
+}
+
+// добавляет город или обновляет его данные и другие названия
+func (s *Index) Add(city structs.CityInfo, names []string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(city.Id)
+	s.add(city, names)
+}
+
+func (s *Index) Remove(id int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(id)
+}
+
+func (s *Index) add(city structs.CityInfo, names []string) {
+	keys := nameKeys(append([]string{city.Name}, names...))
+	for _, key := range keys {
+		current := s.root
+		for _, r := range key {
+			next, ok := current.children[r]
+			if !ok {
+				next = newNode()
+				current.children[r] = next
+			}
+			current = next
+		}
+		current.ids[city.Id] = struct{}{}
+	}
+	s.cities[city.Id] = city
+	s.keys[city.Id] = keys
+}
+
+func (s *Index) find(key string) *node {
+	current := s.root
+	for _, r := range key {
+		current = current.children[r]
+		if current == nil {
+			return nil
+		}
+	}
+	return current
+}
+
+func (s *Index) remove(id int) {
+	for _, key := range s.keys[id] {
+		if current := s.find(key); current != nil {
+			delete(current.ids, id)
+		}
+	}
+	delete(s.cities, id)
+	delete(s.keys, id)
+}
+
+func collect(current *node, found map[int]struct{}) {
+	for id := range current.ids {
+		found[id] = struct{}{}
+	}
+	for _, child := range current.children {
+		collect(child, found)
+	}
+}
+
+// не более limit городов, название которых начинается с prefix, по убыванию численности
+func (s *Index) Suggest(prefix string, limit int) []structs.CityInfo {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found := make(map[int]struct{})
+	for _, key := range translit.Keys(prefix) {
+		if current := s.find(key); current != nil {
+			collect(current, found)
+		}
+	}
+	cities := make([]structs.CityInfo, 0, len(found))
+	for id := range found {
+		cities = append(cities, s.cities[id])
+	}
+	sort.Slice(cities, func(i, j int) bool {
+		if search.MorePopulous(&cities[i], &cities[j]) || search.MorePopulous(&cities[j], &cities[i]) {
+			return search.MorePopulous(&cities[i], &cities[j])
+		}
+		return cities[i].Name < cities[j].Name
+	})
+	if len(cities) > limit {
+		cities = cities[:limit]
+	}
+	return cities
+}
@@ -0,0 +1,79 @@
+//Модуль настройки TLS для узлов и прокси
+
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// минимальная версия протокола по строке вида "1.2", по умолчанию TLS 1.2
+func MinVersion(version string) (uint16, error) {
+	if version == "" {
+		return tls.VersionTLS12, nil
+	}
+	tlsVersion, ok := versions[version]
+	if !ok {
+		return 0, errors.New("unknown TLS version " + version)
+	}
+	return tlsVersion, nil
+}
+
+func certPool(caFile string) (*x509.CertPool, error) {
+	buff, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buff) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+	return pool, nil
+}
+
+// настройки сервера. Если задан clientCA, клиент обязан предъявить сертификат, подписанный этим центром (mTLS)
+func Server(minVersion string, clientCA string) (*tls.Config, error) {
+	tlsVersion, err := MinVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{MinVersion: tlsVersion}
+	if clientCA != "" {
+		config.ClientCAs, err = certPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// настройки клиента: проверка сервера по serverCA (пусто - системные корневые сертификаты)
+// и, если заданы certFile и keyFile, собственный сертификат клиента
+func Client(serverCA string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	var err error
+	if serverCA != "" {
+		config.RootCAs, err = certPool(serverCA)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
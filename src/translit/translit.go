@@ -0,0 +1,124 @@
+//Модуль транслитерации русских названий
+
+//English - распространенная англоязычная запись (BGN/PCGN без диакритики: Nizhny Novgorod, Yekaterinburg пишется
+//как Ekaterinburg), Iso9 - ГОСТ 7.79-2000 система А (ISO 9: Nižnij Novgorod). Fold приводит запись к виду
+//для сравнения: нижний регистр, без диакритики, пробелы и дефисы схлопнуты в один пробел
+
+package translit
+
+import (
+	"strings"
+	"unicode"
+)
+
+var english = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh", 'з': "z", 'и': "i",
+	'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t",
+	'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "",
+	'э': "e", 'ю': "yu", 'я': "ya",
+}
+
+var iso9 = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "ë", 'ж': "ž", 'з': "z", 'и': "i",
+	'й': "j", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t",
+	'у': "u", 'ф': "f", 'х': "h", 'ц': "c", 'ч': "č", 'ш': "š", 'щ': "ŝ", 'ъ': "ʺ", 'ы': "y", 'ь': "ʹ",
+	'э': "è", 'ю': "û", 'я': "â",
+}
+
+// латинские буквы с диакритикой и их замена при сравнении
+var diacritics = map[rune]string{
+	'ë': "e", 'ž': "z", 'č': "c", 'š': "s", 'ŝ': "s", 'è': "e", 'é': "e", 'û': "u", 'â': "a", 'ʺ': "", 'ʹ': "", '\'': "",
+}
+
+// обратная замена для латинского ввода, более длинные сочетания проверяются первыми
+var cyrillic = []struct{ latin, cyrillic string }{
+	{"shch", "щ"}, {"iy", "ий"}, {"yy", "ый"}, {"zh", "ж"}, {"kh", "х"}, {"ts", "ц"}, {"ch", "ч"}, {"sh", "ш"},
+	{"yu", "ю"}, {"ya", "я"}, {"yo", "ё"}, {"ye", "е"}, {"a", "а"}, {"b", "б"}, {"v", "в"}, {"g", "г"},
+	{"d", "д"}, {"e", "е"}, {"z", "з"}, {"i", "и"}, {"j", "й"}, {"k", "к"}, {"l", "л"}, {"m", "м"}, {"n", "н"},
+	{"o", "о"}, {"p", "п"}, {"r", "р"}, {"s", "с"}, {"t", "т"}, {"u", "у"}, {"f", "ф"}, {"h", "х"}, {"c", "ц"},
+	{"x", "кс"}, {"w", "в"}, {"y", "ы"},
+}
+
+func transliterate(s string, table map[rune]string) string {
+	var out strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if latin, ok := table[r]; ok {
+			out.WriteString(latin)
+		} else {
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
+
+// окончания -ий и -ый в англоязычной записи передаются одной y: Нижний -> Nizhny
+func English(s string) string {
+	words := strings.Fields(strings.ToLower(s))
+	for i, word := range words {
+		for _, ending := range []string{"ий", "ый"} {
+			if strings.HasSuffix(word, ending) && len([]rune(word)) > 3 {
+				word = strings.TrimSuffix(word, ending) + "ы"
+			}
+		}
+		words[i] = transliterate(word, english)
+	}
+	return strings.Join(words, " ")
+}
+
+func Iso9(s string) string {
+	return transliterate(s, iso9)
+}
+
+// латинская запись кириллицей (приближенно, для поиска по русским названиям)
+func Cyrillic(s string) string {
+	s = Fold(s)
+	var out strings.Builder
+	for len(s) > 0 {
+		matched := false
+		for _, pair := range cyrillic {
+			if strings.HasPrefix(s, pair.latin) {
+				out.WriteString(pair.cyrillic)
+				s = s[len(pair.latin):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			r := []rune(s)[0]
+			out.WriteRune(r)
+			s = s[len(string(r)):]
+		}
+	}
+	return out.String()
+}
+
+func Fold(s string) string {
+	var out strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if plain, ok := diacritics[r]; ok {
+			out.WriteString(plain)
+		} else if r == '-' || unicode.IsSpace(r) {
+			out.WriteRune(' ')
+		} else {
+			out.WriteRune(r)
+		}
+	}
+	return strings.Join(strings.Fields(out.String()), " ")
+}
+
+// формы названия для сравнения: русская, англоязычная и по ISO 9; латинская строка дополнительно
+// переводится в кириллицу, чтобы сравнить ее с русскими названиями
+func Keys(s string) []string {
+	var keys []string
+	for _, key := range []string{s, English(s), Iso9(s), Cyrillic(s)} {
+		key = Fold(strings.ReplaceAll(strings.ToLower(key), "ё", "е"))
+		duplicate := false
+		for _, existing := range keys {
+			duplicate = duplicate || existing == key
+		}
+		if !duplicate {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,242 @@
+//Модуль проверки входных данных
+
+//Проверки возвращают список нарушений по полям, обработчики отдают его со статусом 422 Unprocessable Entity.
+//Ограничения длины совпадают с размерами столбцов в progreSQL.sql, чтобы до базы не доходили заведомо
+//неверные данные и клиент не получал сырых ошибок PostgreSQL
+
+package validate
+
+import (
+	"bytes"
+	"cities/src/structs"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// наибольшая длина названий города, региона и округа (varchar(30))
+const MAXNAMELENGTH = 30
+
+// наибольшая длина источника данных о численности (varchar(100))
+const MAXSOURCELENGTH = 100
+
+// наибольшая длина другого названия города (cityNames.name varchar(50))
+const MAXOTHERNAMELENGTH = 50
+
+// наибольшая длина перевода названия региона или округа (localizedNames.name varchar(100))
+const MAXTRANSLATIONLENGTH = 100
+
+// наибольшая длина кода региона или округа и кода языка (varchar(10))
+const MAXCODELENGTH = 10
+
+// виды других названий города
+var nameKinds = map[string]bool{"official": true, "historical": true, "colloquial": true}
+
+type Violation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// список нарушений; пустой список означает, что данные верны
+type Violations []Violation
+
+func (v Violations) Error() string {
+	messages := make([]string, len(v))
+	for i, violation := range v {
+		messages[i] = violation.Field + ": " + violation.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (v *Violations) add(field string, format string, args ...interface{}) {
+	*v = append(*v, Violation{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// разбирает json-тело в target, отвергая неизвестные поля и лишние данные после объекта.
+// Ошибка синтаксиса возвращается как есть, неизвестное поле и неверный тип поля - как Violations
+func Decode(body []byte, target interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(target)
+	if err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return Violations{{Field: typeErr.Field, Message: "must be of " + typeErr.Type.String() + " type"}}
+		}
+		if strings.HasPrefix(err.Error(), "json: unknown field ") {
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			return Violations{{Field: field, Message: "unknown field"}}
+		}
+		return err
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return errors.New("unexpected data after JSON object")
+	}
+	return nil
+}
+
+func checkName(v *Violations, field string, value string) {
+	checkText(v, field, value, MAXNAMELENGTH)
+}
+
+// непустая строка не длиннее max символов
+func checkText(v *Violations, field string, value string, max int) {
+	if strings.TrimSpace(value) == "" {
+		v.add(field, "must not be empty")
+	} else if utf8.RuneCountInString(value) > max {
+		v.add(field, "must not be longer than %d characters", max)
+	}
+}
+
+func checkCode(v *Violations, field string, value string) {
+	if utf8.RuneCountInString(value) > MAXCODELENGTH {
+		v.add(field, "must not be longer than %d characters", MAXCODELENGTH)
+	}
+}
+
+// другое название города; пустой Lang означает ru
+func CityName(name *structs.CityName) Violations {
+	var v Violations
+	checkText(&v, "name", name.Name, MAXOTHERNAMELENGTH)
+	checkCode(&v, "lang", name.Lang)
+	if !nameKinds[name.Kind] {
+		v.add("kind", "must be official, historical or colloquial")
+	}
+	if name.ValidFrom != nil && name.ValidTo != nil && *name.ValidFrom > *name.ValidTo {
+		v.add("valid_from", "must not be later than valid_to")
+	}
+	return v
+}
+
+// запись справочника регионов или федеральных округов
+func DictionaryItem(item *structs.DictionaryItem) Violations {
+	var v Violations
+	checkName(&v, "name", item.Name)
+	checkCode(&v, "code", item.Code)
+	if item.DistrictId != nil && *item.DistrictId <= 0 {
+		v.add("district_id", "must be positive")
+	}
+	return v
+}
+
+// перевод названия региона или округа на язык lang
+func DictionaryName(lang string, name *structs.DictionaryName) Violations {
+	var v Violations
+	checkText(&v, "lang", lang, MAXCODELENGTH)
+	checkText(&v, "name", name.Name, MAXTRANSLATIONLENGTH)
+	return v
+}
+
+func City(city *structs.CityInfo) Violations {
+	var v Violations
+	if city.Id <= 0 {
+		v.add("id", "must be positive")
+	}
+	checkName(&v, "name", city.Name)
+	checkName(&v, "region", city.Region)
+	checkName(&v, "district", city.District)
+	if city.Population != nil && *city.Population < 0 {
+		v.add("population", "must not be negative")
+	}
+	if city.Foundation != nil {
+		checkYear(&v, "foundation", *city.Foundation)
+	}
+	if (city.Latitude == nil) != (city.Longitude == nil) {
+		v.add("latitude", "latitude and longitude must be set together")
+	}
+	if city.Latitude != nil && (*city.Latitude < -90 || *city.Latitude > 90) {
+		v.add("latitude", "must be within [-90, 90]")
+	}
+	if city.Longitude != nil && (*city.Longitude < -180 || *city.Longitude > 180) {
+		v.add("longitude", "must be within [-180, 180]")
+	}
+	if city.Area != nil && *city.Area <= 0 {
+		v.add("area_km2", "must be positive")
+	}
+	//вычисляемые поля выводятся в ответах, но не принимаются
+	if city.Age != nil {
+		v.add("age", "is read-only")
+	}
+	if city.Density != nil {
+		v.add("density", "is read-only")
+	}
+	if city.Distance != nil {
+		v.add("distance_km", "is read-only")
+	}
+	if city.Score != nil || city.MatchedBy != "" {
+		v.add("score", "is read-only")
+	}
+	if city.Version != 0 {
+		v.add("version", "is read-only")
+	}
+	return v
+}
+
+// дата вида YYYY-MM-DD или год YYYY (1 января этого года)
+func ParseDate(value string) (time.Time, error) {
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		date, err = time.Parse("2006", value)
+	}
+	if err != nil {
+		return date, errors.New("date must be in YYYY-MM-DD or YYYY format")
+	}
+	return date, nil
+}
+
+func Population(population *structs.NewPopulation) Violations {
+	var v Violations
+	if population.Value < 0 {
+		v.add("value", "must not be negative")
+	}
+	if population.Date != "" {
+		date, err := ParseDate(population.Date)
+		if err != nil {
+			v.add("date", err.Error())
+		} else if date.After(time.Now()) {
+			v.add("date", "must not be in the future")
+		}
+	}
+	if utf8.RuneCountInString(population.Source) > MAXSOURCELENGTH {
+		v.add("source", "must not be longer than %d characters", MAXSOURCELENGTH)
+	}
+	return v
+}
+
+// год: до нашей эры - отрицательный, нулевого года нет
+func checkYear(v *Violations, field string, year int) {
+	if year == 0 {
+		v.add(field, "year 0 does not exist, use -1 for 1 BC and 1 for 1 AD")
+	}
+	if current := time.Now().Year(); year > current {
+		v.add(field, "must not be later than %d", current)
+	}
+}
+
+// диапазон значений; nonNegative - для численности, years - для годов
+func Values(values *structs.Values, nonNegative bool, years bool) Violations {
+	var v Violations
+	if values.Unknown && (values.MinValue != nil || values.MaxValue != nil) {
+		v.add("unknown", "must not be combined with min_value or max_value")
+	}
+	bounds := []struct {
+		field string
+		value *int
+	}{{"min_value", values.MinValue}, {"max_value", values.MaxValue}}
+	for _, bound := range bounds {
+		if bound.value != nil && nonNegative && *bound.value < 0 {
+			v.add(bound.field, "must not be negative")
+		}
+		if bound.value != nil && years && *bound.value == 0 {
+			v.add(bound.field, "year 0 does not exist, use -1 for 1 BC and 1 for 1 AD")
+		}
+	}
+	if values.MinValue != nil && values.MaxValue != nil && *values.MinValue > *values.MaxValue {
+		v.add("min_value", "must not be greater than max_value")
+	}
+	return v
+}